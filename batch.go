@@ -0,0 +1,184 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// DefaultBatchConcurrency is the default maximum number of
+// uncached lookups run at once by LookupAsnBatch.
+const DefaultBatchConcurrency = 16
+
+// BatchOptions customizes LookupAsnBatch.
+type BatchOptions struct {
+	// Concurrency is the maximum number of
+	// uncached lookups run at once.
+	// Zero means DefaultBatchConcurrency.
+	Concurrency int
+}
+
+// BatchResult is the outcome of the ASN lookup of an IP address
+// by LookupAsnBatch.
+type BatchResult struct {
+	// IP address, as given to LookupAsnBatch
+	IP string
+	// ASN data, if found
+	AsnInfo
+	// Lookup error, if any
+	Err error
+}
+
+// LookupAsnBatch searches for the ASN of several IP addresses at once.
+//
+// Cached data is answered right away.
+// Cache misses are looked up like LookupAsn does,
+// with at most opts.Concurrency lookups at once,
+// except that AsnDescriber sources (e.g. CymruDnsSource)
+// are queried once per distinct ASN found.
+//
+// Returns a result per IP address, in the same order as ips.
+func (h Handler) LookupAsnBatch(ips []string, opts BatchOptions) []BatchResult {
+	return h.LookupAsnBatchContext(context.Background(), ips, opts)
+}
+
+// LookupAsnBatchContext is like LookupAsnBatch,
+// but gives up when ctx is done.
+//
+// The deadline of ctx bounds the whole batch.
+// Lookups not finished when ctx is done fail with ctx.Err().
+func (h Handler) LookupAsnBatchContext(ctx context.Context, ips []string, opts BatchOptions) []BatchResult {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	results := make([]BatchResult, len(ips))
+	// Indexes of results waiting for an uncached lookup,
+	// by canonical IP address
+	misses := make(map[netip.Addr][]int)
+	var missOrder []netip.Addr
+	for i, ip := range ips {
+		results[i].IP = ip
+		addr, ok := iputils.ParseAddr(ip)
+		if !ok {
+			results[i].Err = MalformedIPError
+			continue
+		}
+		if iputils.IsLocalAddr(addr) {
+			results[i].Err = PrivateIPError
+			continue
+		}
+		info, expired, found, err := h.cache.lookupByIP(addr)
+		h.metrics.cacheLookup(info, expired, found)
+		if found && !expired {
+			results[i].AsnInfo, results[i].Err = info, err
+			continue
+		}
+		if found && info.Cache == CacheStale {
+			h.refreshStale(addr)
+			results[i].AsnInfo = info
+			continue
+		}
+		if _, ok := misses[addr]; !ok {
+			missOrder = append(missOrder, addr)
+		}
+		misses[addr] = append(misses[addr], i)
+	}
+	if len(missOrder) == 0 {
+		return results
+	}
+	// Query sources for cache misses.
+	found := make([]BatchResult, len(missOrder))
+	runBounded(len(missOrder), concurrency, func(i int) {
+		info, err := h.querySources(ctx, missOrder[i].String(), true)
+		found[i] = BatchResult{AsnInfo: info, Err: err}
+	})
+	// Describe distinct ASNs found without description.
+	var undescribed []string
+	descrs := make(map[string]string)
+	for _, r := range found {
+		if r.Err != nil || r.Descr != "" {
+			continue
+		}
+		if _, ok := descrs[r.Asn]; !ok {
+			descrs[r.Asn] = ""
+			undescribed = append(undescribed, r.Asn)
+		}
+	}
+	var mu sync.Mutex
+	runBounded(len(undescribed), concurrency, func(i int) {
+		asn := undescribed[i]
+		descr := h.describeAsn(ctx, asn)
+		mu.Lock()
+		descrs[asn] = descr
+		mu.Unlock()
+	})
+	// Apply overrides, update cache and answer.
+	for i, r := range found {
+		addr := missOrder[i]
+		if r.Err != nil {
+			h.cache.storeError(addr, r.Err)
+		} else {
+			if r.Descr == "" {
+				r.Descr = descrs[r.Asn]
+			}
+			if err := ctx.Err(); err != nil {
+				r.AsnInfo, r.Err = AsnInfo{}, err
+			} else {
+				h.overrideDescr(ctx, &r.AsnInfo)
+				r.AsnInfo = h.cache.store(addr, r.AsnInfo)
+			}
+		}
+		for _, j := range misses[addr] {
+			results[j].AsnInfo, results[j].Err = r.AsnInfo, r.Err
+		}
+	}
+	return results
+}
+
+// runBounded calls f for every integer in [0, n),
+// with at most concurrency calls running at once.
+// Returns after all calls are done.
+func runBounded(n int, concurrency int, f func(int)) {
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/geoipdb"
+)
+
+// batchSource is a concurrency safe AsnSource
+// answering undescribed ASNs from a table.
+type batchSource struct {
+	mu         sync.Mutex
+	asns       map[string]string
+	calls      int
+	running    int
+	maxRunning int
+}
+
+func (s *batchSource) Name() string {
+	return "batch"
+}
+
+func (s *batchSource) LookupAsn(ctx context.Context, ip string, _ string) (geoipdb.AsnInfo, error) {
+	s.mu.Lock()
+	s.calls++
+	s.running++
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+	s.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	asn, ok := s.asns[ip]
+	if !ok {
+		return geoipdb.AsnInfo{}, fmt.Errorf("no ASN for %s", ip)
+	}
+	return geoipdb.AsnInfo{Asn: asn}, nil
+}
+
+// batchDescriber is a concurrency safe AsnDescriber
+// counting queries per ASN.
+type batchDescriber struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (s *batchDescriber) Name() string {
+	return "describer"
+}
+
+func (s *batchDescriber) LookupAsn(ctx context.Context, _ string, asn string) (geoipdb.AsnInfo, error) {
+	if asn == "" {
+		return geoipdb.AsnInfo{}, geoipdb.SourceNotApplicableError
+	}
+	descr, err := s.DescribeAsn(ctx, asn)
+	return geoipdb.AsnInfo{Asn: asn, Descr: descr}, err
+}
+
+func (s *batchDescriber) DescribeAsn(ctx context.Context, asn string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[asn]++
+	return "Descr of " + asn, nil
+}
+
+func TestLookupAsnBatch(t *testing.T) {
+	src := &batchSource{asns: make(map[string]string)}
+	var ips []string
+	for i := 0; i < 30; i++ {
+		ip := fmt.Sprintf("45.45.45.%d", i+1)
+		src.asns[ip] = fmt.Sprintf("AS%d", 100+i%3)
+		ips = append(ips, ip)
+	}
+	ips = append(ips, "45.45.45.1", "10.0.0.1", "not an ip", "45.45.46.1")
+	describer := &batchDescriber{calls: make(map[string]int)}
+	h := newSourcesHandler(t, src, describer)
+	results := h.LookupAsnBatch(ips, geoipdb.BatchOptions{Concurrency: 4})
+	if len(results) != len(ips) {
+		t.Fatalf("expected %d results, got %d", len(ips), len(results))
+	}
+	for i, r := range results {
+		if r.IP != ips[i] {
+			t.Fatalf("result %d is for ip '%s', expected '%s'", i, r.IP, ips[i])
+		}
+		switch r.IP {
+		case "10.0.0.1":
+			if r.Err != geoipdb.PrivateIPError {
+				t.Fatalf("unexpected error for %s: %v", r.IP, r.Err)
+			}
+		case "not an ip":
+			if r.Err != geoipdb.MalformedIPError {
+				t.Fatalf("unexpected error for %s: %v", r.IP, r.Err)
+			}
+		case "45.45.46.1":
+			if r.Err == nil {
+				t.Fatalf("expected an error for %s", r.IP)
+			}
+		default:
+			asn := src.asns[r.IP]
+			if r.Err != nil || r.Asn != asn || r.Descr != "Descr of "+asn {
+				t.Fatalf("unexpected result for %s: %+v", r.IP, r)
+			}
+		}
+	}
+	if src.maxRunning > 4 {
+		t.Fatalf("concurrency limit exceeded: %d lookups at once", src.maxRunning)
+	}
+	if src.calls != 31 {
+		t.Fatalf("expected 31 source queries, got %d", src.calls)
+	}
+	for asn, n := range describer.calls {
+		if n != 1 {
+			t.Fatalf("%s was described %d times", asn, n)
+		}
+	}
+	if len(describer.calls) != 3 {
+		t.Fatalf("expected 3 described ASNs, got %v", describer.calls)
+	}
+	// All answers are cached now.
+	h.LookupAsnBatch(ips[:30], geoipdb.BatchOptions{})
+	if src.calls != 31 {
+		t.Fatalf("cached answers were looked up again")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOverridesBucket is the bucket of overrides in a bbolt database,
+// mapping ASNs to descriptions.
+var boltOverridesBucket = []byte("overrides")
+
+// BoltOverrides is an OverridesStore backed by a bbolt database,
+// an embedded key/value store in a single file.
+type BoltOverrides struct {
+	db *bolt.DB
+}
+
+// NewBoltOverrides returns a BoltOverrides backed by a given database,
+// to be closed by the caller after use:
+//
+//	db, err := bolt.Open("/var/lib/geoipdb/overrides.db", 0600, nil)
+//	...
+//	store, err := geoipdb.NewBoltOverrides(db)
+//
+// Returns an error if the overrides bucket cannot be created.
+func NewBoltOverrides(db *bolt.DB) (*BoltOverrides, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltOverridesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltOverrides{db: db}, nil
+}
+
+// Lookup implements OverridesStore.
+func (b *BoltOverrides) Lookup(ctx context.Context, asn string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var name string
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(boltOverridesBucket).Get([]byte(asn)); value != nil {
+			name, found = string(value), true
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", OverridesAsnNotFoundError
+	}
+	return name, nil
+}
+
+// Set implements OverridesStore.
+func (b *BoltOverrides) Set(ctx context.Context, asn string, descr string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOverridesBucket).Put([]byte(asn), []byte(descr))
+	})
+}
+
+// Remove implements OverridesStore.
+func (b *BoltOverrides) Remove(ctx context.Context, asn string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOverridesBucket).Delete([]byte(asn))
+	})
+}
+
+// List implements OverridesStore.
+// Overrides are sorted by ASN.
+func (b *BoltOverrides) List(ctx context.Context) ([]AsnOverride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	answer := []AsnOverride{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOverridesBucket).ForEach(func(asn, name []byte) error {
+			answer = append(answer, AsnOverride{Asn: string(asn), Name: string(name)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// Apply sets and removes several overrides at once,
+// in a single transaction (see OverridesImport).
+func (b *BoltOverrides) Apply(ctx context.Context, set []AsnOverride, remove []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltOverridesBucket)
+		for _, asn := range remove {
+			if err := bucket.Delete([]byte(asn)); err != nil {
+				return err
+			}
+		}
+		for _, override := range set {
+			if err := bucket.Put([]byte(override.Asn), []byte(override.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -26,124 +26,329 @@
 package geoipdb
 
 import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
 	"sync"
 	"time"
 )
 
-// cacheTTL is the expiration time of a cache entry.
-const cacheTTL = time.Hour * 24
+// DefaultCacheTTL is the default expiration time of cached ASN data.
+const DefaultCacheTTL = time.Hour * 24
 
-// cacheEntry is the data we want to keep cached.
-type cacheEntry struct {
-	// ASN number
-	asn string
-	// ASN description
-	descr string
-	// Due date of this entry
-	due time.Time
+// CacheBackendUnsupportedError is returned by Handler methods
+// requiring features the cache backend does not have.
+var CacheBackendUnsupportedError = errors.New("operation not supported by cache backend")
+
+// CacheConfig configures the LookupAsn cache of a Handler.
+type CacheConfig struct {
+	// Backend stores the cache entries.
+	// Nil means a MemoryCache of MaxEntries, swept every SweepInterval
+	// (see NewMemoryCache).
+	Backend CacheBackend
+	// TTL is the expiration time of cached ASN data.
+	// Zero means DefaultCacheTTL.
+	TTL time.Duration
+	// SourceTTL overrides TTL for the ASN data found by given sources,
+	// by source name (see AsnSource).
+	// A zero or negative duration disables caching of these data.
+	SourceTTL map[string]time.Duration
+	// NegativeTTL is the expiration time of cached "unknown ASN" errors,
+	// sparing sources repeated lookups of unroutable IP addresses.
+	// Lookups failed by every source are not cached.
+	// Zero disables caching of errors.
+	NegativeTTL time.Duration
+	// MaxStale is how long after expiry ASN data is still answered,
+	// while refreshed in the background,
+	// so that callers do not wait for sources on expiry.
+	// Zero disables answering expired data.
+	MaxStale time.Duration
+	// SnapshotPath, if not empty, is a file the cache is loaded from
+	// by NewHandler, and saved to by Handler.Close
+	// (see CacheSave and CacheLoad).
+	SnapshotPath string
+	// MaxEntries is the maximum number of cached prefixes
+	// of the default backend.
+	MaxEntries int
+	// SweepInterval is the period of the background removal
+	// of expired entries of the default backend.
+	SweepInterval time.Duration
+}
+
+// CacheEntry is what the LookupAsn cache knows about an IP prefix.
+type CacheEntry struct {
+	// Prefix is the range of IP addresses this entry answers.
+	// It is the prefix reported by sources if any,
+	// otherwise the host prefix (/32 or /128) of the looked up address.
+	Prefix *net.IPNet
+	// Info is the ASN data, empty if Negative.
+	Info AsnInfo
+	// Negative tells that no source knows the ASN of the prefix.
+	Negative bool
+	// IPs are the IP addresses whose lookup created this entry,
+	// or refreshed it with the same ASN, in canonical form.
+	IPs []string
+	// Expires is when the data expires.
+	Expires time.Time
+	// Due is when the entry is to be removed, not before Expires.
+	Due time.Time
+	// Inserted is when the entry was stored.
+	Inserted time.Time
+	// Hits is the number of lookups answered by the entry,
+	// kept while refreshed with the same ASN.
+	// Always zero for MongoCache.
+	Hits uint64
+}
+
+// CacheBackend stores the entries of the LookupAsn cache.
+// Implementations must be safe for concurrent use.
+//
+// The Handler decides what is cached and for how long;
+// backends only have to remove entries once due.
+// IP addresses given to backends are canonical:
+// IPv4-mapped IPv6 addresses are unmapped, and have no zone.
+type CacheBackend interface {
+	// Lookup retrieves the entry of the longest cached prefix
+	// containing a given IP address, if any.
+	// Its IPs field may be left empty.
+	Lookup(ip netip.Addr) (CacheEntry, bool, error)
+	// Store adds the entry created by the lookup of a given IP address,
+	// replacing the entry of the same prefix
+	// (keeping its IP addresses if of the same ASN),
+	// and any more specific entry answering the IP address.
+	// The IPs field of entry is ignored.
+	Store(ip netip.Addr, entry CacheEntry) error
+	// AsnIPs retrieves the IP addresses of the entries of a given ASN.
+	AsnIPs(asn string) ([]string, error)
+	// Asns retrieves the ASNs of all positive entries.
+	Asns() ([]string, error)
+	// PurgeAsn removes the entries of a given ASN.
+	PurgeAsn(asn string) error
+	// PurgeAll removes all entries.
+	PurgeAll() error
+	// Close releases the resources of the backend.
+	Close() error
 }
 
-// cache allows manipulating cached data.
+// cacheSnapshotter is a CacheBackend supporting snapshots
+// (see CacheSave and CacheLoad).
+type cacheSnapshotter interface {
+	Save(w io.Writer) error
+	Load(r io.Reader) error
+}
+
+// cache applies the caching policy of a Handler to its backend.
 type cache struct {
-	// Concurrent access control to maps
-	*sync.RWMutex
-	// IP to ASN data
-	ip map[string]cacheEntry
-	// ASN to IP list
-	asn map[string]map[string]interface{}
+	backend CacheBackend
+	// Expiration times
+	ttl         time.Duration
+	sourceTTL   map[string]time.Duration
+	negativeTTL time.Duration
+	maxStale    time.Duration
+	// Snapshot file, if any
+	snapshotPath string
+	// Prefixes of the entries being refreshed in the background
+	refreshing *sync.Map
+	// Log messages destination
+	logger *logger
+	// Prefix overrides of the Handler
+	routes *routeTable
 }
 
-// newCache returns an empty initialized cache.
-func newCache() cache {
-	return cache{
-		&sync.RWMutex{},
-		make(map[string]cacheEntry),
-		make(map[string]map[string]interface{}),
+// newCache returns a cache configured by config,
+// backed by a new MemoryCache unless config tells a backend.
+func newCache(config CacheConfig) cache {
+	c := cache{
+		backend:      config.Backend,
+		ttl:          config.TTL,
+		sourceTTL:    make(map[string]time.Duration),
+		negativeTTL:  config.NegativeTTL,
+		maxStale:     config.MaxStale,
+		snapshotPath: config.SnapshotPath,
+		refreshing:   &sync.Map{},
+	}
+	if c.backend == nil {
+		c.backend = NewMemoryCache(config.MaxEntries, config.SweepInterval)
 	}
+	if c.ttl <= 0 {
+		c.ttl = DefaultCacheTTL
+	}
+	for name, ttl := range config.SourceTTL {
+		c.sourceTTL[name] = ttl
+	}
+	return c
 }
 
-// store updates the cache.
-func (c cache) store(ip string, asn string, descr string) {
-	if ip == "" {
-		return
+// close closes the backend, after saving the cache to its snapshot file
+// if configured.
+func (c cache) close() error {
+	if c.backend == nil {
+		return nil
 	}
-	c.Lock()
-	defer c.Unlock()
-	// Purge ASN map of given ip
-	for _, ips := range c.asn {
-		delete(ips, ip)
+	var err error
+	if c.snapshotPath != "" {
+		err = c.saveSnapshot(c.snapshotPath)
 	}
-	// Purge ASN map of empty entries
-	for asn, ips := range c.asn {
-		if len(ips) < 1 {
-			delete(c.asn, asn)
+	if closeErr := c.backend.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// cachePrefix returns the prefix to cache the ASN data of ip with:
+// the prefix reported by sources if it contains ip,
+// otherwise the host prefix of ip.
+func cachePrefix(ip netip.Addr, info AsnInfo) *net.IPNet {
+	ipAddr := net.IP(ip.AsSlice())
+	if _, prefix, err := net.ParseCIDR(info.Prefix); err == nil {
+		if _, bits := prefix.Mask.Size(); bits == ip.BitLen() && prefix.Contains(ipAddr) {
+			return prefix
 		}
 	}
-	// Update IP map
-	c.ip[ip] = cacheEntry{
-		asn:   asn,
-		descr: descr,
-		due:   time.Now().Add(cacheTTL),
+	return &net.IPNet{IP: ipAddr, Mask: net.CIDRMask(ip.BitLen(), ip.BitLen())}
+}
+
+// store updates the cache with the ASN data of ip.
+//
+// Returns the stored ASN data, with its cache status and expiry.
+func (c cache) store(ip netip.Addr, info AsnInfo) AsnInfo {
+	ttl, ok := c.sourceTTL[info.Source]
+	if !ok {
+		ttl = c.ttl
+	}
+	info.Cache = CacheMiss
+	info.Expires = time.Now().Add(ttl)
+	if !ip.IsValid() || ttl <= 0 {
+		return info
+	}
+	prefix := cachePrefix(ip, info)
+	if c.routes.shadows(prefix, info.Source == PrefixOverrideSource) {
+		// Do not answer the addresses of other overrides of the prefix
+		prefix = &net.IPNet{IP: net.IP(ip.AsSlice()), Mask: net.CIDRMask(ip.BitLen(), ip.BitLen())}
 	}
-	// Update ASN map
-	if c.asn[asn] == nil {
-		c.asn[asn] = make(map[string]interface{})
+	c.put(ip, CacheEntry{
+		Prefix:  prefix,
+		Info:    info,
+		Expires: info.Expires,
+	})
+	return info
+}
+
+// storeError updates the cache with the lookup error of ip,
+// if err is an "unknown ASN" error and negative caching is enabled.
+func (c cache) storeError(ip netip.Addr, err error) {
+	if _, ok := err.(unknownAsnError); !ok || c.negativeTTL <= 0 || !ip.IsValid() {
+		return
 	}
-	c.asn[asn][ip] = nil
+	c.put(ip, CacheEntry{
+		Prefix:   cachePrefix(ip, AsnInfo{}),
+		Negative: true,
+		Expires:  time.Now().Add(c.negativeTTL),
+	})
 }
 
-// lookupByIP retrieves cached data by IP address.
+// put stores an entry in the backend, due after its stale period.
+func (c cache) put(ip netip.Addr, entry CacheEntry) {
+	entry.Inserted = time.Now()
+	entry.Due = entry.Expires
+	if !entry.Negative {
+		entry.Due = entry.Due.Add(c.maxStale)
+	}
+	if err := c.backend.Store(ip, entry); err != nil {
+		c.logger.log(LogWarn, "cannot cache ASN data", LogField{"ip", ip.String()}, LogField{"err", err})
+	}
+}
+
+// lookupByIP retrieves cached data by IP address,
+// from the longest cached prefix containing it.
+//
+// Expired ASN data still in its stale period (see CacheConfig.MaxStale)
+// is answered with cache status CacheStale.
 //
 // Returns
-// the ASN identification and description,
+// the ASN data,
 // if cached data is expired,
-// and if ip was found in cache.
-func (c cache) lookupByIP(ip string) (asn string, descr string, expired bool, found bool) {
-	c.RLock()
-	defer c.RUnlock()
-	entry, ok := c.ip[ip]
+// if ip was found in cache,
+// and the cached lookup error if ip is known to have no ASN.
+func (c cache) lookupByIP(ip netip.Addr) (info AsnInfo, expired bool, found bool, err error) {
+	if !ip.IsValid() {
+		return AsnInfo{}, false, false, nil
+	}
+	entry, ok, err := c.backend.Lookup(ip)
+	if err != nil {
+		c.logger.log(LogWarn, "cache lookup failed", LogField{"ip", ip.String()}, LogField{"err", err})
+		return AsnInfo{}, false, false, nil
+	}
 	if !ok {
-		return "", "", false, false
+		return AsnInfo{}, false, false, nil
+	}
+	now := time.Now()
+	expired = now.After(entry.Expires)
+	if entry.Negative {
+		return AsnInfo{}, expired, true, unknownAsnError(ip.String())
+	}
+	info = entry.Info
+	info.Cache = CacheHit
+	if expired && now.Before(entry.Expires.Add(c.maxStale)) {
+		info.Cache = CacheStale
 	}
-	return entry.asn, entry.descr, time.Now().After(entry.due), true
+	info.Expires = entry.Expires
+	return info, expired, true, nil
 }
 
-// lookupByASN retrieves the list of cached IPs associated with a given ASN.
+// claimRefresh marks the entry answering ip as being refreshed.
+//
+// Returns
+// the key to release the mark with (see releaseRefresh),
+// and false if there is no such entry or if it is already claimed.
+func (c cache) claimRefresh(ip netip.Addr) (string, bool) {
+	if !ip.IsValid() {
+		return "", false
+	}
+	entry, ok, err := c.backend.Lookup(ip)
+	if err != nil || !ok {
+		return "", false
+	}
+	key := entry.Prefix.String()
+	if _, claimed := c.refreshing.LoadOrStore(key, nil); claimed {
+		return "", false
+	}
+	return key, true
+}
+
+// releaseRefresh clears a refresh mark set by claimRefresh.
+func (c cache) releaseRefresh(key string) {
+	c.refreshing.Delete(key)
+}
+
+// lookupByASN retrieves the list of cached IPs associated with a given ASN,
+// that is the IPs whose lookup created or refreshed a cache entry.
 //
 // Returns a non nil list of IP addresses.
 func (c cache) lookupByASN(asn string) map[string]interface{} {
-	c.RLock()
-	defer c.RUnlock()
-	answer, ok := c.asn[asn]
-	if !ok || answer == nil {
-		return make(map[string]interface{})
+	answer := make(map[string]interface{})
+	ips, err := c.backend.AsnIPs(asn)
+	if err != nil {
+		c.logger.log(LogWarn, "cannot list cached IPs", LogField{"asn", asn}, LogField{"err", err})
+	}
+	for _, ip := range ips {
+		answer[ip] = nil
 	}
 	return answer
 }
 
 // purgeASN removes from the cache all information related to a given ASN.
 func (c cache) purgeASN(asn string) {
-	c.Lock()
-	defer c.Unlock()
-	// Purge ip map of given asn
-	for ip, entry := range c.ip {
-		if entry.asn == asn {
-			delete(c.ip, ip)
-		}
+	if err := c.backend.PurgeAsn(asn); err != nil {
+		c.logger.log(LogWarn, "cannot purge cached data", LogField{"asn", asn}, LogField{"err", err})
 	}
-	// Purge asn map of given asn
-	delete(c.asn, asn)
 }
 
 // purgeAll removes all entries from the cache
 func (c cache) purgeAll() {
-	c.Lock()
-	defer c.Unlock()
-	for ip, _ := range c.ip {
-		delete(c.ip, ip)
-	}
-	for asn, _ := range c.asn {
-		delete(c.asn, asn)
+	if err := c.backend.PurgeAll(); err != nil {
+		c.logger.log(LogWarn, "cannot purge cache", LogField{"err", err})
 	}
 }
 
@@ -151,13 +356,12 @@ func (c cache) purgeAll() {
 //
 // Returns a non nil list of ASNs.
 func (c cache) asnList() []string {
-	c.RLock()
-	defer c.RUnlock()
-	answer := make([]string, len(c.asn))
-	var i int
-	for asn := range c.asn {
-		answer[i] = asn
-		i++
+	asns, err := c.backend.Asns()
+	if err != nil {
+		c.logger.log(LogWarn, "cannot list cached ASNs", LogField{"err", err})
 	}
-	return answer
+	if asns == nil {
+		return []string{}
+	}
+	return asns
 }
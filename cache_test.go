@@ -0,0 +1,374 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrefixTableMatch(t *testing.T) {
+	table := newPrefixTable()
+	for _, cidr := range []string{"1.0.0.0/8", "1.2.0.0/16", "1.2.3.4/32", "2001:db8::/32", "2001:db8:1::/48", "0.0.0.0/0"} {
+		_, prefix, _ := net.ParseCIDR(cidr)
+		table.insert(prefix, cidr)
+	}
+	tests := map[string]string{
+		"1.2.3.4":         "1.2.3.4/32",
+		"1.2.3.5":         "1.2.0.0/16",
+		"1.3.0.1":         "1.0.0.0/8",
+		"9.9.9.9":         "0.0.0.0/0",
+		"::ffff:1.2.9.9":  "1.2.0.0/16",
+		"2001:db8:1:2::1": "2001:db8:1::/48",
+		"2001:db8:2::1":   "2001:db8::/32",
+		"2001:db9::1":     "",
+	}
+	for ip, expected := range tests {
+		value, ok := table.match(netip.MustParseAddr(ip))
+		if ok != (expected != "") || (ok && value.(string) != expected) {
+			t.Fatalf("unexpected match for %s: %v %v", ip, value, ok)
+		}
+	}
+	if table.len() != 6 {
+		t.Fatalf("unexpected table length: %d", table.len())
+	}
+	_, prefix, _ := net.ParseCIDR("1.2.0.0/16")
+	table.remove(prefix)
+	if value, _ := table.match(netip.MustParseAddr("1.2.3.5")); value.(string) != "1.0.0.0/8" {
+		t.Fatalf("unexpected match after remove: %v", value)
+	}
+	var walked []string
+	table.walk(func(prefix *net.IPNet, value interface{}) bool {
+		if prefix.String() != value.(string) {
+			t.Fatalf("walked prefix %s holds %v", prefix, value)
+		}
+		walked = append(walked, prefix.String())
+		return true
+	})
+	sort.Strings(walked)
+	if strings.Join(walked, ",") != "0.0.0.0/0,1.0.0.0/8,1.2.3.4/32,2001:db8:1::/48,2001:db8::/32" {
+		t.Fatalf("unexpected walked prefixes: %v", walked)
+	}
+}
+
+func TestCachePrefix(t *testing.T) {
+	c := newCache(CacheConfig{SweepInterval: -1})
+	c.store(netip.MustParseAddr("1.0.0.3"), AsnInfo{Asn: "AS13335", Prefix: "1.0.0.0/24"})
+	c.store(netip.MustParseAddr("1.0.0.4"), AsnInfo{Asn: "AS13335", Prefix: "1.0.0.0/24"})
+	// A prefix not containing the IP is cached as a host prefix.
+	c.store(netip.MustParseAddr("8.8.8.8"), AsnInfo{Asn: "AS15169", Prefix: "1.0.0.0/24"})
+	c.store(netip.MustParseAddr("2001:4860::1"), AsnInfo{Asn: "AS15169"})
+	if info, _, found, _ := c.lookupByIP(netip.MustParseAddr("1.0.0.200")); !found || info.Asn != "AS13335" {
+		t.Fatalf("1.0.0.200 not answered by its prefix: %+v", info)
+	}
+	if _, _, found, _ := c.lookupByIP(netip.MustParseAddr("8.8.8.9")); found {
+		t.Fatalf("8.8.8.9 answered by a host prefix")
+	}
+	if _, _, found, _ := c.lookupByIP(netip.MustParseAddr("2001:4860::2")); found {
+		t.Fatalf("2001:4860::2 answered by a host prefix")
+	}
+	if n := memoryBackend(c).Len(); n != 3 {
+		t.Fatalf("unexpected number of cached prefixes: %d", n)
+	}
+	ips := c.lookupByASN("AS13335")
+	if _, ok := ips["1.0.0.3"]; !ok || len(ips) != 2 {
+		t.Fatalf("unexpected IPs of AS13335: %v", ips)
+	}
+	// A covering prefix replaces the more specific one answering the IP.
+	c.store(netip.MustParseAddr("1.0.0.5"), AsnInfo{Asn: "AS13336", Prefix: "1.0.0.0/16"})
+	if info, _, _, _ := c.lookupByIP(netip.MustParseAddr("1.0.0.3")); info.Asn != "AS13336" {
+		t.Fatalf("1.0.0.3 answered by a replaced prefix: %+v", info)
+	}
+	if list := c.asnList(); len(list) != 2 {
+		t.Fatalf("unexpected cached ASNs: %v", list)
+	}
+	checkCacheIndexes(t, c)
+	c.purgeASN("AS15169")
+	if _, _, found, _ := c.lookupByIP(netip.MustParseAddr("8.8.8.8")); found {
+		t.Fatalf("8.8.8.8 cached after purge")
+	}
+	checkCacheIndexes(t, c)
+	c.purgeAll()
+	if memoryBackend(c).Len() != 0 || len(c.asnList()) != 0 {
+		t.Fatalf("cache not empty after purge")
+	}
+	checkCacheIndexes(t, c)
+}
+
+// memoryBackend returns the MemoryCache backing c.
+func memoryBackend(c cache) *MemoryCache {
+	return c.backend.(*MemoryCache)
+}
+
+// memoryShard returns the shard of the bucket of ip
+// in the MemoryCache backing c.
+func memoryShard(c cache, ip string) *memShard {
+	return memoryBackend(c).bucketShard(netip.MustParseAddr(ip))
+}
+
+// checkCacheIndexes fails if the indexes of the MemoryCache backing c disagree.
+func checkCacheIndexes(t *testing.T, c cache) {
+	for _, s := range memoryBackend(c).all() {
+		var byAsn, negative int
+		for e := s.lru.Front(); e != nil; e = e.Next() {
+			if e.Value.(*memEntry).Negative {
+				negative++
+			}
+		}
+		for asn, entries := range s.asn {
+			if len(entries) == 0 {
+				t.Fatalf("empty ASN map entry for %s", asn)
+			}
+			for key, entry := range entries {
+				if value, ok := s.prefixes.get(entry.Prefix); !ok || value.(*memEntry) != entry {
+					t.Fatalf("ASN map entry %s %s not in prefix table", asn, key)
+				}
+			}
+			byAsn += len(entries)
+		}
+		if n := s.prefixes.len(); byAsn+negative != n || s.lru.Len() != n || s.expiry.Len() != n {
+			t.Fatalf("cache indexes disagree: %d prefixes, %d in ASN map, %d in LRU list, %d in expiry heap",
+				n, byAsn, s.lru.Len(), s.expiry.Len())
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(CacheConfig{MaxEntries: 3, SweepInterval: -1})
+	for i := 1; i <= 3; i++ {
+		c.store(netip.MustParseAddr(fmt.Sprintf("1.0.%d.1", i)), AsnInfo{Asn: fmt.Sprintf("AS%d", i)})
+	}
+	// Use the oldest entry, so that the second one is evicted.
+	if _, _, found, _ := c.lookupByIP(netip.MustParseAddr("1.0.1.1")); !found {
+		t.Fatalf("1.0.1.1 not cached")
+	}
+	c.store(netip.MustParseAddr("1.0.4.1"), AsnInfo{Asn: "AS4"})
+	if _, _, found, _ := c.lookupByIP(netip.MustParseAddr("1.0.2.1")); found {
+		t.Fatalf("least recently used entry not evicted")
+	}
+	for _, ip := range []string{"1.0.1.1", "1.0.3.1", "1.0.4.1"} {
+		if _, _, found, _ := c.lookupByIP(netip.MustParseAddr(ip)); !found {
+			t.Fatalf("%s evicted", ip)
+		}
+	}
+	if list := c.asnList(); len(list) != 3 {
+		t.Fatalf("unexpected cached ASNs: %v", list)
+	}
+	checkCacheIndexes(t, c)
+}
+
+func TestCacheSweep(t *testing.T) {
+	c := newCache(CacheConfig{SweepInterval: -1})
+	c.store(netip.MustParseAddr("1.0.0.1"), AsnInfo{Asn: "AS1"})
+	c.store(netip.MustParseAddr("1.0.0.2"), AsnInfo{Asn: "AS1"})
+	c.store(netip.MustParseAddr("1.0.0.3"), AsnInfo{Asn: "AS2"})
+	if n := memoryBackend(c).sweep(time.Now()); n != 0 {
+		t.Fatalf("unexpected number of swept entries: %d", n)
+	}
+	if n := memoryBackend(c).sweep(time.Now().Add(DefaultCacheTTL + time.Second)); n != 3 {
+		t.Fatalf("unexpected number of swept entries: %d", n)
+	}
+	if len(c.asnList()) != 0 || len(c.lookupByASN("AS1")) != 0 {
+		t.Fatalf("ASN map not swept")
+	}
+	checkCacheIndexes(t, c)
+}
+
+func TestCacheJanitor(t *testing.T) {
+	c := newCache(CacheConfig{SweepInterval: time.Millisecond})
+	defer c.close()
+	c.store(netip.MustParseAddr("1.0.0.1"), AsnInfo{Asn: "AS1"})
+	m := memoryBackend(c)
+	s := memoryShard(c, "1.0.0.1")
+	s.mu.Lock()
+	s.expiry[0].Due = time.Now()
+	s.mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for m.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entry not swept by janitor")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.close()
+	c.close()
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newCache(CacheConfig{
+		TTL:           time.Hour,
+		SourceTTL:     map[string]time.Duration{"ipinfo": time.Minute, "nocache": 0},
+		NegativeTTL:   time.Second,
+		SweepInterval: -1,
+	})
+	now := time.Now()
+	tests := []struct {
+		ip     string
+		source string
+		ttl    time.Duration
+	}{
+		{"1.0.0.1", "libgeoip", time.Hour},
+		{"1.0.0.2", "ipinfo", time.Minute},
+	}
+	for _, test := range tests {
+		info := c.store(netip.MustParseAddr(test.ip), AsnInfo{Asn: "AS1", Source: test.source})
+		if d := info.Expires.Sub(now); d < test.ttl || d > test.ttl+time.Second {
+			t.Fatalf("unexpected TTL of %s data: %s", test.source, d)
+		}
+	}
+	c.store(netip.MustParseAddr("1.0.0.3"), AsnInfo{Asn: "AS1", Source: "nocache"})
+	if _, _, found, _ := c.lookupByIP(netip.MustParseAddr("1.0.0.3")); found {
+		t.Fatalf("data of uncached source stored")
+	}
+	// Only unknown ASN errors are cached.
+	c.storeError(netip.MustParseAddr("1.0.0.4"), PrivateIPError)
+	if _, _, found, _ := c.lookupByIP(netip.MustParseAddr("1.0.0.4")); found {
+		t.Fatalf("unexpected error stored")
+	}
+	c.storeError(netip.MustParseAddr("1.0.0.5"), unknownAsnError("1.0.0.5"))
+	_, expired, found, err := c.lookupByIP(netip.MustParseAddr("1.0.0.5"))
+	if !found || expired || err == nil || err.Error() != "unknown ASN for ip '1.0.0.5'" {
+		t.Fatalf("unexpected negative entry: %v %v %v", expired, found, err)
+	}
+	if list := c.asnList(); len(list) != 1 || list[0] != "AS1" {
+		t.Fatalf("unexpected cached ASNs: %v", list)
+	}
+	checkCacheIndexes(t, c)
+	if n := memoryBackend(c).sweep(now.Add(2 * time.Second)); n != 1 {
+		t.Fatalf("unexpected number of swept entries: %d", n)
+	}
+	checkCacheIndexes(t, c)
+}
+
+func TestCacheStale(t *testing.T) {
+	c := newCache(CacheConfig{TTL: time.Minute, MaxStale: time.Hour, SweepInterval: -1})
+	c.store(netip.MustParseAddr("1.0.0.1"), AsnInfo{Asn: "AS1"})
+	s := memoryShard(c, "1.0.0.1")
+	s.mu.Lock()
+	s.expiry[0].Expires = time.Now().Add(-time.Second)
+	s.expiry[0].Due = s.expiry[0].Expires.Add(time.Hour)
+	s.mu.Unlock()
+	info, expired, found, _ := c.lookupByIP(netip.MustParseAddr("1.0.0.1"))
+	if !found || !expired || info.Cache != CacheStale {
+		t.Fatalf("unexpected stale lookup: %+v %v %v", info, expired, found)
+	}
+	key, ok := c.claimRefresh(netip.MustParseAddr("1.0.0.1"))
+	if _, twice := c.claimRefresh(netip.MustParseAddr("1.0.0.1")); !ok || twice {
+		t.Fatalf("refresh claimed twice")
+	}
+	c.releaseRefresh(key)
+	if _, ok := c.claimRefresh(netip.MustParseAddr("1.0.0.1")); !ok {
+		t.Fatalf("refresh not released")
+	}
+	// Stale entries are swept after their stale period.
+	if n := memoryBackend(c).sweep(time.Now()); n != 0 {
+		t.Fatalf("stale entry swept")
+	}
+	if n := memoryBackend(c).sweep(time.Now().Add(2 * time.Hour)); n != 1 {
+		t.Fatalf("stale entry not swept")
+	}
+}
+
+func TestMongoCacheKeys(t *testing.T) {
+	keys := mongoCacheKeys(netip.MustParseAddr("1.2.3.4"), 30)
+	if strings.Join(keys, ",") != "1.2.3.4/32,1.2.3.4/31,1.2.3.4/30" {
+		t.Fatalf("unexpected IPv4 keys: %v", keys)
+	}
+	if keys := mongoCacheKeys(netip.MustParseAddr("2001:db8::1"), 0); len(keys) != 129 || keys[128] != "::/0" || keys[1] != "2001:db8::/127" {
+		t.Fatalf("unexpected IPv6 keys: %v", keys)
+	}
+}
+
+func TestMongoCacheDoc(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("1.0.0.0/24")
+	entry := CacheEntry{
+		Prefix: prefix,
+		Info: AsnInfo{Asn: "AS13335", Number: 13335, Descr: "Cloudflare", RawDescr: "CLOUDFLARENET",
+			Overriden: true, Source: "cymru-origin", Prefix: "1.0.0.0/23", Country: "AU", Registry: "apnic"},
+		IPs:     []string{"1.0.0.1"},
+		Expires: time.Unix(1000, 0),
+		Due:     time.Unix(2000, 0),
+	}
+	entry.Info.Expires = entry.Expires
+	decoded, err := newMongoCacheDoc(entry).entry()
+	if err != nil || !reflect.DeepEqual(decoded, entry) {
+		t.Fatalf("unexpected decoded entry: %+v %v", decoded, err)
+	}
+}
+
+// benchmarkMemoryCache measures parallel operations on a MemoryCache
+// of a given number of shards, filled with /24 prefixes.
+// Run with -cpu 1,2,4,8 to see throughput scaling with GOMAXPROCS.
+func benchmarkMemoryCache(b *testing.B, shards int, storeRatio int) {
+	const prefixes = 1 << 14
+	m := newMemoryCache(-1, -1, shards)
+	defer m.Close()
+	ips := make([]netip.Addr, prefixes)
+	entries := make([]CacheEntry, prefixes)
+	for i := range ips {
+		ips[i] = netip.AddrFrom4([4]byte{byte(1 + i>>8), byte(i), 0, 1})
+		_, prefix, _ := net.ParseCIDR(fmt.Sprintf("%s/24", ips[i]))
+		entries[i] = CacheEntry{Prefix: prefix, Info: AsnInfo{Asn: fmt.Sprintf("AS%d", i%100)}}
+		m.Store(ips[i], entries[i])
+	}
+	var seed uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Per goroutine pseudo-random sequence
+		r := atomic.AddUint32(&seed, 1) * 2654435761
+		for pb.Next() {
+			r = r*1664525 + 1013904223
+			i := int(r>>8) % prefixes
+			if storeRatio > 0 && int(r>>24)%storeRatio == 0 {
+				m.Store(ips[i], entries[i])
+			} else {
+				m.Lookup(ips[i])
+			}
+		}
+	})
+}
+
+func BenchmarkMemoryCacheLookup(b *testing.B) {
+	b.Run("shards=1", func(b *testing.B) { benchmarkMemoryCache(b, 1, 0) })
+	b.Run(fmt.Sprintf("shards=%d", memoryCacheShards), func(b *testing.B) { benchmarkMemoryCache(b, memoryCacheShards, 0) })
+}
+
+func BenchmarkMemoryCacheStore(b *testing.B) {
+	b.Run("shards=1", func(b *testing.B) { benchmarkMemoryCache(b, 1, 1) })
+	b.Run(fmt.Sprintf("shards=%d", memoryCacheShards), func(b *testing.B) { benchmarkMemoryCache(b, memoryCacheShards, 1) })
+}
+
+func BenchmarkMemoryCacheMixed(b *testing.B) {
+	b.Run("shards=1", func(b *testing.B) { benchmarkMemoryCache(b, 1, 10) })
+	b.Run(fmt.Sprintf("shards=%d", memoryCacheShards), func(b *testing.B) { benchmarkMemoryCache(b, memoryCacheShards, 10) })
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// CymruDnsSource is an AsnSource backed by Team Cymru's DNS service.
+//
+// It can only describe an ASN already found by a preceding source,
+// so it is meant to be placed after those in the list of sources.
+type CymruDnsSource struct {
+	// Resolver sends the queries to Team Cymru's DNS service.
+	Resolver *DnsResolver
+	// Concurrent descriptions of the same ASN
+	flights flightGroup
+}
+
+// NewCymruDnsSource creates a CymruDnsSource
+// querying the nameservers of DefaultResolvConf.
+//
+// Parameter timeout limits the duration of each query attempt.
+// Pass zero to disable timeout.
+func NewCymruDnsSource(timeout time.Duration) *CymruDnsSource {
+	return &CymruDnsSource{
+		Resolver: newDefaultDnsResolver(timeout),
+	}
+}
+
+// Name implements AsnSource.
+func (s *CymruDnsSource) Name() string {
+	return "cymru"
+}
+
+// LookupAsn implements AsnSource.
+//
+// Returns SourceNotApplicableError if parameter asn is empty.
+func (s *CymruDnsSource) LookupAsn(ctx context.Context, _ string, asn string) (AsnInfo, error) {
+	if asn == "" {
+		return AsnInfo{}, SourceNotApplicableError
+	}
+	descr, err := s.DescribeAsn(ctx, asn)
+	if err != nil {
+		return AsnInfo{}, err
+	}
+	return AsnInfo{Asn: asn, Descr: descr}, nil
+}
+
+// DescribeAsn implements AsnDescriber.
+//
+// Concurrent calls for the same ASN share a single query.
+func (s *CymruDnsSource) DescribeAsn(ctx context.Context, asn string) (string, error) {
+	descr, err := s.flights.do(ctx, asn, func() (interface{}, error) {
+		return cymruClient{s.Resolver}.lookup(ctx, asn)
+	})
+	if err != nil {
+		return "", err
+	}
+	return descr.(string), nil
+}
+
+// CymruOrigin is what Team Cymru's IP to ASN mapping service
+// knows about an IP address.
+type CymruOrigin struct {
+	// ASN identifications originating the BGP prefix
+	Asns []string
+	// BGP prefix, in CIDR notation
+	Prefix string
+	// Country code
+	Country string
+	// Regional Internet Registry, e.g. "arin"
+	Registry string
+	// Allocation date, zero if unknown
+	Allocated time.Time
+}
+
+// CymruOriginSource is an AsnSource backed by
+// Team Cymru's IP to ASN mapping DNS service.
+//
+// It answers ASNs without description,
+// so it is meant to be followed by a CymruDnsSource in the list of sources.
+type CymruOriginSource struct {
+	// Resolver sends the queries to Team Cymru's DNS service.
+	Resolver *DnsResolver
+}
+
+// NewCymruOriginSource creates a CymruOriginSource
+// querying the nameservers of DefaultResolvConf.
+//
+// Parameter timeout limits the duration of each query attempt.
+// Pass zero to disable timeout.
+func NewCymruOriginSource(timeout time.Duration) *CymruOriginSource {
+	return &CymruOriginSource{
+		Resolver: newDefaultDnsResolver(timeout),
+	}
+}
+
+// Name implements AsnSource.
+func (s *CymruOriginSource) Name() string {
+	return "cymru-origin"
+}
+
+// LookupAsn implements AsnSource.
+func (s *CymruOriginSource) LookupAsn(ctx context.Context, ip string, _ string) (AsnInfo, error) {
+	origin, err := cymruClient{s.Resolver}.lookupOrigin(ctx, ip)
+	if err != nil {
+		return AsnInfo{}, err
+	}
+	return AsnInfo{
+		Asn:      origin.Asns[0],
+		Prefix:   origin.Prefix,
+		Country:  origin.Country,
+		Registry: origin.Registry,
+	}, nil
+}
+
+// cymruClient can do DNS queries to Team Cymru's database
+// for retrieving ASN descriptions and IP to ASN mappings.
+type cymruClient struct {
+	resolver *DnsResolver
+}
+
+// queryTXT retrieves the TXT records of a given domain name.
+// The query is abandoned when ctx is done.
+//
+// Returns the contents of the TXT records found.
+func (cc cymruClient) queryTXT(ctx context.Context, name string) ([]string, error) {
+	if cc.resolver == nil {
+		return nil, fmt.Errorf("cymruClient not initialized")
+	}
+	msg := new(dns.Msg)
+	msg.Id = dns.Id()
+	msg.RecursionDesired = true
+	msg.Question = make([]dns.Question, 1)
+	msg.Question[0] = dns.Question{
+		Name:   name,
+		Qtype:  dns.TypeTXT,
+		Qclass: dns.ClassINET,
+	}
+	msg, err := cc.resolver.exchange(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	var answer []string
+	for _, ans := range msg.Answer {
+		if t, ok := ans.(*dns.TXT); ok {
+			answer = append(answer, strings.Join(t.Txt, ""))
+		}
+	}
+	return answer, nil
+}
+
+// lookup retrieves the description of a given ASN
+// by reaching Team Cymru's DNS database.
+// The query is abandoned when ctx is done.
+//
+// Returns the ASN description.
+func (cc cymruClient) lookup(ctx context.Context, asn string) (string, error) {
+	if asn == "" {
+		return "", fmt.Errorf("empty asn parameter")
+	}
+	txts, err := cc.queryTXT(ctx, asn+".asn.cymru.com.")
+	if err != nil {
+		return "", err
+	}
+	if len(txts) < 1 {
+		return "", fmt.Errorf("no description found for asn '%s'", asn)
+	}
+	return strings.TrimSpace(reDNSFilter.ReplaceAllString(txts[0], "")), nil
+}
+
+// lookupOrigin retrieves the origin of a given ip address
+// by reaching Team Cymru's IP to ASN mapping DNS database.
+// The query is abandoned when ctx is done.
+//
+// If ip is covered by several BGP prefixes,
+// the most specific one is answered.
+//
+// Returns the origin data of ip,
+// or SourceUnknownAsnError if ip is not routed.
+func (cc cymruClient) lookupOrigin(ctx context.Context, ip string) (CymruOrigin, error) {
+	name, err := cymruOriginName(ip)
+	if err != nil {
+		return CymruOrigin{}, err
+	}
+	txts, err := cc.queryTXT(ctx, name)
+	if err != nil {
+		return CymruOrigin{}, err
+	}
+	var answer CymruOrigin
+	bestBits := -1
+	for _, txt := range txts {
+		origin, err := parseCymruOrigin(txt)
+		if err != nil {
+			return CymruOrigin{}, err
+		}
+		_, inet, err := net.ParseCIDR(origin.Prefix)
+		if err != nil {
+			return CymruOrigin{}, fmt.Errorf("malformed prefix in cymru answer '%s'", txt)
+		}
+		if bits, _ := inet.Mask.Size(); bits > bestBits {
+			answer, bestBits = origin, bits
+		}
+	}
+	if bestBits < 0 {
+		return CymruOrigin{}, SourceUnknownAsnError
+	}
+	return answer, nil
+}
+
+// cymruOriginName answers the domain name to be queried
+// for the origin of a given ip address,
+// made of its reversed octets (IPv4) or nibbles (IPv6).
+func cymruOriginName(ip string) (string, error) {
+	ipAddr, isIPv4 := iputils.ParseIP(ip)
+	if ipAddr == nil {
+		return "", MalformedIPError
+	}
+	var labels []string
+	if isIPv4 {
+		ip4 := ipAddr.To4()
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%d", ip4[i]))
+		}
+		return strings.Join(labels, ".") + ".origin.asn.cymru.com.", nil
+	}
+	ip6 := ipAddr.To16()
+	for i := len(ip6) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x.%x", ip6[i]&0x0F, ip6[i]>>4))
+	}
+	return strings.Join(labels, ".") + ".origin6.asn.cymru.com.", nil
+}
+
+// parseCymruOrigin parses a TXT record of Team Cymru's
+// IP to ASN mapping service, such as:
+//
+//	15169 | 8.8.8.0/24 | US | arin | 1992-12-01
+//
+// Returns the origin data.
+func parseCymruOrigin(txt string) (CymruOrigin, error) {
+	fields := strings.Split(txt, "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 2 {
+		return CymruOrigin{}, fmt.Errorf("malformed cymru answer '%s'", txt)
+	}
+	var answer CymruOrigin
+	for _, asn := range strings.Fields(fields[0]) {
+		if !reASN.MatchString("AS" + asn) {
+			return CymruOrigin{}, fmt.Errorf("malformed cymru answer '%s'", txt)
+		}
+		answer.Asns = append(answer.Asns, "AS"+asn)
+	}
+	if len(answer.Asns) < 1 {
+		return CymruOrigin{}, fmt.Errorf("malformed cymru answer '%s'", txt)
+	}
+	answer.Prefix = fields[1]
+	if len(fields) > 2 {
+		answer.Country = fields[2]
+	}
+	if len(fields) > 3 {
+		answer.Registry = fields[3]
+	}
+	if len(fields) > 4 {
+		answer.Allocated, _ = time.Parse("2006-01-02", fields[4])
+	}
+	return answer, nil
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serveDNS runs a local DNS server until the test ends.
+// Parameter network is either "udp" or "tcp".
+//
+// Returns the server address.
+func serveDNS(t *testing.T, network string, addr string, handler dns.HandlerFunc) string {
+	started := make(chan struct{})
+	server := &dns.Server{Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	if network == "tcp" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("cannot listen: %s", err)
+		}
+		server.Listener = l
+		addr = l.Addr().String()
+	} else {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatalf("cannot listen: %s", err)
+		}
+		server.PacketConn = pc
+		addr = pc.LocalAddr().String()
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return addr
+}
+
+// txtHandler answers TXT records from a table indexed by domain name.
+func txtHandler(records map[string][]string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		txts, ok := records[strings.ToLower(q.Name)]
+		if !ok {
+			m.Rcode = dns.RcodeNameError
+		}
+		for _, txt := range txts {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{txt},
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+// rcodeHandler answers every query with a given response code.
+func rcodeHandler(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+	}
+}
+
+// startDNSServer runs a local UDP DNS server until the test ends,
+// answering TXT records from a table indexed by domain name.
+//
+// Returns the server address.
+func startDNSServer(t *testing.T, records map[string][]string) string {
+	return serveDNS(t, "udp", "127.0.0.1:0", txtHandler(records))
+}
+
+func newTestResolver(t *testing.T, servers ...string) *DnsResolver {
+	r, err := NewDnsResolver(DnsResolverConfig{Servers: servers, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewDnsResolver failed: %s", err)
+	}
+	return r
+}
+
+// cymruRecords is a sample of Team Cymru's DNS database.
+var cymruRecords = map[string][]string{
+	"8.8.8.8.origin.asn.cymru.com.": {"15169 | 8.8.8.0/24 | US | arin | 1992-12-01"},
+	"31.108.90.216.origin.asn.cymru.com.": {
+		"701 | 216.90.0.0/16 | US | arin | 1998-09-25",
+		"23028 701 | 216.90.108.0/24 | US | arin | 1998-09-25",
+	},
+	"2.0.1.0.6.7.8.0.0.0.0.0.0.0.0.0.0.0.0.0.4.0.0.1.0.6.8.4.1.0.0.2.origin6.asn.cymru.com.": {
+		"15169 | 2001:4860::/32 | US | arin | 2005-03-14",
+	},
+	"1.1.1.1.origin.asn.cymru.com.": {"garbage"},
+	"as15169.asn.cymru.com.":        {"15169 | US | arin | 2000-03-30 | GOOGLE - Google LLC, US"},
+}
+
+func newTestCymruClient(t *testing.T) cymruClient {
+	return cymruClient{newTestResolver(t, startDNSServer(t, cymruRecords))}
+}
+
+func TestCymruOriginName(t *testing.T) {
+	tests := map[string]string{
+		"8.8.4.4":                 "4.4.8.8.origin.asn.cymru.com.",
+		"2001:4860:1004::876:102": "2.0.1.0.6.7.8.0.0.0.0.0.0.0.0.0.0.0.0.0.4.0.0.1.0.6.8.4.1.0.0.2.origin6.asn.cymru.com.",
+	}
+	for ip, expected := range tests {
+		name, err := cymruOriginName(ip)
+		if err != nil || name != expected {
+			t.Fatalf("unexpected cymruOriginName(\"%s\") result: %s %v", ip, name, err)
+		}
+	}
+	if _, err := cymruOriginName("ns1.google.com"); err != MalformedIPError {
+		t.Fatalf("unexpected cymruOriginName error: %v", err)
+	}
+}
+
+func TestCymruLookupOrigin(t *testing.T) {
+	cc := newTestCymruClient(t)
+	tests := map[string]CymruOrigin{
+		"8.8.8.8": {
+			Asns:      []string{"AS15169"},
+			Prefix:    "8.8.8.0/24",
+			Country:   "US",
+			Registry:  "arin",
+			Allocated: time.Date(1992, 12, 1, 0, 0, 0, 0, time.UTC),
+		},
+		"216.90.108.31": {
+			Asns:      []string{"AS23028", "AS701"},
+			Prefix:    "216.90.108.0/24",
+			Country:   "US",
+			Registry:  "arin",
+			Allocated: time.Date(1998, 9, 25, 0, 0, 0, 0, time.UTC),
+		},
+		"2001:4860:1004::876:102": {
+			Asns:      []string{"AS15169"},
+			Prefix:    "2001:4860::/32",
+			Country:   "US",
+			Registry:  "arin",
+			Allocated: time.Date(2005, 3, 14, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for ip, expected := range tests {
+		origin, err := cc.lookupOrigin(context.Background(), ip)
+		if err != nil {
+			t.Fatalf("lookupOrigin(\"%s\") failed: %s", ip, err)
+		}
+		if !reflect.DeepEqual(origin, expected) {
+			t.Fatalf("unexpected lookupOrigin(\"%s\") result: %+v", ip, origin)
+		}
+	}
+	for _, ip := range []string{"1.1.1.1", "9.9.9.9"} {
+		if _, err := cc.lookupOrigin(context.Background(), ip); err == nil {
+			t.Fatalf("lookupOrigin(\"%s\") did not fail", ip)
+		}
+	}
+}
+
+func TestCymruOriginSourceChain(t *testing.T) {
+	r := newTestResolver(t, startDNSServer(t, cymruRecords))
+	origin := &CymruOriginSource{Resolver: r}
+	describer := &CymruDnsSource{Resolver: r}
+	h, err := NewHandler(nil, time.Second, WithSources(origin, describer))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	asn, descr, err := h.LookupAsn("8.8.8.8")
+	if err != nil || asn != "AS15169" || descr != "GOOGLE - Google LLC, US" {
+		t.Fatalf("unexpected LookupAsn result: %s %s %v", asn, descr, err)
+	}
+	if _, err := h.CymruOriginLookup("216.90.108.31"); err != nil {
+		t.Fatalf("CymruOriginLookup failed: %s", err)
+	}
+}
+
+func TestCymruDescribeAsnShared(t *testing.T) {
+	var queries int32
+	records := txtHandler(cymruRecords)
+	server := serveDNS(t, "udp", "127.0.0.1:0", func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(50 * time.Millisecond)
+		records(w, r)
+	})
+	src := &CymruDnsSource{Resolver: newTestResolver(t, server)}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			descr, err := src.DescribeAsn(context.Background(), "AS15169")
+			if err != nil || descr != "GOOGLE - Google LLC, US" {
+				t.Errorf("unexpected DescribeAsn result: %s %v", descr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("concurrent descriptions not coalesced: %d queries", n)
+	}
+}
+
+func TestDnsResolverFailover(t *testing.T) {
+	// A closed port
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	closed := pc.LocalAddr().String()
+	pc.Close()
+	failing := serveDNS(t, "udp", "127.0.0.1:0", rcodeHandler(dns.RcodeServerFailure))
+	cc := cymruClient{newTestResolver(t, closed, failing, startDNSServer(t, cymruRecords))}
+	descr, err := cc.lookup(context.Background(), "AS15169")
+	if err != nil || descr != "GOOGLE - Google LLC, US" {
+		t.Fatalf("unexpected lookup result: %s %v", descr, err)
+	}
+	cc = cymruClient{newTestResolver(t, closed, failing)}
+	if _, err := cc.lookup(context.Background(), "AS15169"); err == nil {
+		t.Fatalf("lookup did not fail")
+	}
+}
+
+func TestDnsResolverTruncated(t *testing.T) {
+	truncating := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		w.WriteMsg(m)
+	}
+	addr := serveDNS(t, "udp", "127.0.0.1:0", truncating)
+	serveDNS(t, "tcp", addr, txtHandler(cymruRecords))
+	cc := cymruClient{newTestResolver(t, addr)}
+	descr, err := cc.lookup(context.Background(), "AS15169")
+	if err != nil || descr != "GOOGLE - Google LLC, US" {
+		t.Fatalf("unexpected lookup result: %s %v", descr, err)
+	}
+	r, err := NewDnsResolver(DnsResolverConfig{Servers: []string{addr}, TCP: true, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewDnsResolver failed: %s", err)
+	}
+	if _, err := (cymruClient{r}).lookup(context.Background(), "AS15169"); err != nil {
+		t.Fatalf("lookup over TCP failed: %s", err)
+	}
+}
+
+func TestDnsResolverServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "search example.com\nnameserver 192.0.2.53\nnameserver 2001:db8::53\n"
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatalf("cannot write %s: %s", path, err)
+	}
+	r, err := NewDnsResolver(DnsResolverConfig{ResolvConf: path})
+	if err != nil {
+		t.Fatalf("NewDnsResolver failed: %s", err)
+	}
+	expected := []string{"192.0.2.53:53", "[2001:db8::53]:53"}
+	if !reflect.DeepEqual(r.Servers(), expected) {
+		t.Fatalf("unexpected servers: %v", r.Servers())
+	}
+	r, err = NewDnsResolver(DnsResolverConfig{Servers: []string{LocalResolver, "192.0.2.1", "::1"}})
+	if err != nil {
+		t.Fatalf("NewDnsResolver failed: %s", err)
+	}
+	expected = []string{"127.0.0.1:53", "192.0.2.1:53", "[::1]:53"}
+	if !reflect.DeepEqual(r.Servers(), expected) {
+		t.Fatalf("unexpected servers: %v", r.Servers())
+	}
+	if _, err := NewDnsResolver(DnsResolverConfig{ResolvConf: path + ".missing"}); err == nil {
+		t.Fatalf("NewDnsResolver accepted a missing configuration file")
+	}
+}
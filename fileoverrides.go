@@ -0,0 +1,267 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileOverrides is an OverridesStore backed by a JSON or YAML file
+// listing AsnOverride objects, such as:
+//
+//	[
+//	  {"asn": "AS13335", "name": "Cloudflare"},
+//	  {"asn": "AS15169", "name": "Google"}
+//	]
+//
+// The file format is told by its extension: ".json", ".yaml" or ".yml".
+// The file is reloaded when changed by other means,
+// and rewritten atomically when changed through the store.
+// A missing file holds no overrides, and is created on first change.
+type FileOverrides struct {
+	path string
+	yaml bool
+	// Period of the checks for changes of the file
+	checkInterval time.Duration
+	// Concurrent access control to the fields below
+	mu sync.Mutex
+	// Description overrides, by ASN
+	names map[string]string
+	// Modification date and size of the file when last read
+	modTime time.Time
+	size    int64
+	// Date of the last check for changes
+	checked time.Time
+	// Error reading the changed file, until fixed
+	err error
+}
+
+// NewFileOverrides returns a FileOverrides backed by a given file,
+// checked for changes at most every checkInterval, on access.
+// Pass zero to check on every access.
+//
+// Returns an error if the file extension is not supported,
+// or if the file cannot be read.
+func NewFileOverrides(path string, checkInterval time.Duration) (*FileOverrides, error) {
+	f := &FileOverrides{path: path, checkInterval: checkInterval, names: make(map[string]string)}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		f.yaml = true
+	default:
+		return nil, fmt.Errorf("unsupported overrides file format '%s'", filepath.Ext(path))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// refresh reloads the file if changed since read,
+// unless checked less than checkInterval ago.
+// Caller must hold the lock.
+func (f *FileOverrides) refresh() error {
+	now := time.Now()
+	if !f.checked.IsZero() && now.Sub(f.checked) < f.checkInterval {
+		return f.err
+	}
+	f.checked = now
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		f.names, f.modTime, f.size, f.err = make(map[string]string), time.Time{}, 0, nil
+		return nil
+	}
+	if err != nil {
+		f.err = err
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.err
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		f.err = err
+		return err
+	}
+	var overrides []AsnOverride
+	if f.yaml {
+		err = yaml.Unmarshal(data, &overrides)
+	} else if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &overrides)
+	}
+	if err != nil {
+		f.err = fmt.Errorf("cannot parse '%s': %s", f.path, err)
+		return f.err
+	}
+	f.names = make(map[string]string, len(overrides))
+	for _, override := range overrides {
+		f.names[override.Asn] = override.Name
+	}
+	f.modTime, f.size, f.err = info.ModTime(), info.Size(), nil
+	return nil
+}
+
+// write replaces the file by a given set of overrides, atomically.
+// Caller must hold the lock.
+func (f *FileOverrides) write(names map[string]string) error {
+	overrides := sortedOverrides(names)
+	var data []byte
+	var err error
+	if f.yaml {
+		data, err = yaml.Marshal(overrides)
+	} else {
+		data, err = json.MarshalIndent(overrides, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(replacedFileMode(f.path)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.names, f.modTime, f.size, f.err = names, info.ModTime(), info.Size(), nil
+	return nil
+}
+
+// replacedFileMode answers the permissions of the file at path,
+// to be kept by the file replacing it, or 0644 if there is none.
+func replacedFileMode(path string) os.FileMode {
+	if info, err := os.Stat(path); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+// update applies a change to a copy of the overrides,
+// then writes them.
+func (f *FileOverrides) update(ctx context.Context, change func(names map[string]string)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checked = time.Time{}
+	if err := f.refresh(); err != nil {
+		return err
+	}
+	names := make(map[string]string, len(f.names)+1)
+	for asn, name := range f.names {
+		names[asn] = name
+	}
+	change(names)
+	return f.write(names)
+}
+
+// Lookup implements OverridesStore.
+func (f *FileOverrides) Lookup(ctx context.Context, asn string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.refresh(); err != nil {
+		return "", err
+	}
+	name, ok := f.names[asn]
+	if !ok {
+		return "", OverridesAsnNotFoundError
+	}
+	return name, nil
+}
+
+// Set implements OverridesStore.
+func (f *FileOverrides) Set(ctx context.Context, asn string, descr string) error {
+	return f.update(ctx, func(names map[string]string) {
+		names[asn] = descr
+	})
+}
+
+// Remove implements OverridesStore.
+func (f *FileOverrides) Remove(ctx context.Context, asn string) error {
+	return f.update(ctx, func(names map[string]string) {
+		delete(names, asn)
+	})
+}
+
+// List implements OverridesStore.
+// Overrides are sorted by ASN.
+func (f *FileOverrides) List(ctx context.Context) ([]AsnOverride, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+	return sortedOverrides(f.names), nil
+}
+
+// Version answers the modification date and size of the file,
+// so that an OverridesMirror reloads overrides only when changed.
+func (f *FileOverrides) Version(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.refresh(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", f.modTime.UnixNano(), f.size), nil
+}
+
+// Apply sets and removes several overrides at once,
+// in a single write of the file (see OverridesImport).
+func (f *FileOverrides) Apply(ctx context.Context, set []AsnOverride, remove []string) error {
+	return f.update(ctx, func(names map[string]string) {
+		applyOverrides(names, set, remove)
+	})
+}
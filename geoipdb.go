@@ -38,21 +38,30 @@ as it wraps more than one search method.
 
 If you want a specific service to be queried for ASN,
 see other Handler lookup methods.
+
+Legacy libgeoip ASN databases are no longer published.
+For querying a GeoLite2-ASN or DB-IP ASN Lite database instead,
+create the Handler with WithSources and a MmdbSource, e.g.:
+
+	db, err := geoipdb.NewMmdbSource("/usr/share/GeoIP/GeoLite2-ASN.mmdb")
+	...
+	gh, err := geoipdb.NewHandler(nil, timeout, geoipdb.WithSources(
+		db,
+		geoipdb.NewIpInfoSource(timeout),
+		geoipdb.NewCymruDnsSource(timeout),
+	))
 */
 package geoipdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"net/netip"
 	"regexp"
-	"strings"
+	"strconv"
 	"time"
 
-	"github.com/abh/geoip"
-	"github.com/miekg/dns"
 	"github.com/turbobytes/geoipdb/iputils"
 	"gopkg.in/mgo.v2"
 )
@@ -74,156 +83,583 @@ var (
 var (
 	// MalformedIPError is returned on parse failure of IP parameter.
 	MalformedIPError = errors.New("malformed IP address")
+	// MalformedPrefixError is returned on parse failure of CIDR parameter.
+	MalformedPrefixError = errors.New("malformed IP prefix")
 	// PrivateIPError is returned on AS lookup of a private IP address.
 	PrivateIPError = errors.New("private IP address")
 )
 
+// unknownAsnError is returned when no source knows the ASN of an IP address.
+// Such errors are cached for CacheConfig.NegativeTTL.
+type unknownAsnError string
+
+func (ip unknownAsnError) Error() string {
+	return fmt.Sprintf("unknown ASN for ip '%v'", string(ip))
+}
+
+// sourcesFailedError is returned when no source answered the ASN
+// of an IP address because every source queried failed.
+// Unlike unknownAsnError, such errors are not cached.
+type sourcesFailedError struct {
+	ip  string
+	err error // Last source failure
+}
+
+func (e sourcesFailedError) Error() string {
+	return fmt.Sprintf("cannot lookup ASN for ip '%v': %s", e.ip, e.err)
+}
+
+// CacheStatus tells how an answer relates to the LookupAsn cache.
+type CacheStatus int
+
+const (
+	// CacheMiss means the answer was looked up in the sources.
+	CacheMiss CacheStatus = iota
+	// CacheHit means the answer was taken from the cache.
+	CacheHit
+	// CacheStale means the answer was taken from an expired cache entry,
+	// being refreshed in the background (see CacheConfig.MaxStale).
+	CacheStale
+)
+
+// String implements fmt.Stringer.
+func (s CacheStatus) String() string {
+	switch s {
+	case CacheMiss:
+		return "miss"
+	case CacheHit:
+		return "hit"
+	case CacheStale:
+		return "stale"
+	}
+	return "unknown"
+}
+
+// AsnInfo is what is known about the ASN of an IP address.
+type AsnInfo struct {
+	// ASN identification, e.g. "AS15169"
+	Asn string
+	// ASN number, e.g. 15169
+	Number uint32
+	// ASN description,
+	// taken from the overrides collection if Overriden is true
+	Descr string
+	// ASN description as answered by the sources
+	RawDescr string
+	// Overriden tells if Descr was taken from the overrides collection
+	Overriden bool
+	// Source is the name of the source which found the ASN
+	Source string
+	// Prefix covering the IP address in CIDR notation, if known
+	Prefix string
+	// Country code, if known
+	Country string
+	// Regional Internet Registry, if known
+	Registry string
+	// Cache is the cache status of this answer
+	Cache CacheStatus
+	// Expires is when the cache entry of this answer expires
+	Expires time.Time
+}
+
+// asnNumber answers the number of a given ASN identification,
+// or zero if asn is malformed.
+func asnNumber(asn string) uint32 {
+	if !reASN.MatchString(asn) {
+		return 0
+	}
+	n, _ := strconv.ParseUint(asn[2:], 10, 32)
+	return uint32(n)
+}
+
 // Handler is a handler to TurboBytes GeoIP helper functions.
 type Handler struct {
-	geoip4    *geoip.GeoIP
-	geoip6    *geoip.GeoIP
-	cymru     cymruClient
+	sources   []AsnSource
+	libgeoip  *LibGeoipSource
+	mmdb      *MmdbSource
+	ipinfo    *IpInfoSource
+	cymru     *CymruDnsSource
+	origin    *CymruOriginSource
+	whois     *CymruWhoisClient
+	resolver  *DnsResolver
 	timeout   time.Duration
-	overrides *mgo.Collection
+	overrides OverridesStore
+	cacheConf CacheConfig
 	cache     cache
+	// Refresh period of the overrides mirror, if any (see WithOverridesMirror)
+	mirrorInterval time.Duration
+	mirror         *OverridesMirror
+	// Prefix overrides (see WithPrefixOverrides)
+	routes *routeTable
+	// Concurrent uncached lookups of the same IP address
+	flights *flightGroup
+	// Counters exposed by MetricsHandler
+	metrics *metrics
+	// Log messages destination (see WithLogger)
+	logger *logger
+}
+
+// HandlerOption customizes a Handler created by NewHandler.
+type HandlerOption func(*Handler)
+
+// WithSources defines the sources queried by LookupAsn, in order.
+// By default, the sources answered by DefaultSources are used.
+//
+// Handler methods bound to a specific service
+// (LibGeoipLookup, MmdbLookup, IpInfoLookup,
+// CymruOriginLookup and CymruDnsLookup)
+// use the corresponding source of the list, if any.
+func WithSources(sources ...AsnSource) HandlerOption {
+	return func(h *Handler) {
+		h.sources = append([]AsnSource{}, sources...)
+	}
+}
+
+// WithCymruWhois defines the client used by CymruWhoisLookup.
+// By default, Team Cymru's whois service is queried
+// with the Handler timeout (see NewHandler).
+func WithCymruWhois(c *CymruWhoisClient) HandlerOption {
+	return func(h *Handler) {
+		h.whois = c
+	}
+}
+
+// WithIpInfo defines the ipinfo.io source
+// of the default sources when WithSources is not given,
+// and the one backing IpInfoLookup.
+// By default, ipinfo.io is queried anonymously
+// with the Handler timeout (see NewHandler).
+func WithIpInfo(s *IpInfoSource) HandlerOption {
+	return func(h *Handler) {
+		h.ipinfo = s
+	}
+}
+
+// WithDnsResolver defines the resolver of the Team Cymru sources
+// created by NewHandler,
+// i.e. the default sources when WithSources is not given,
+// and those backing CymruOriginLookup and CymruDnsLookup
+// when not in the list of sources.
+// By default, the nameservers of DefaultResolvConf are queried.
+func WithDnsResolver(r *DnsResolver) HandlerOption {
+	return func(h *Handler) {
+		h.resolver = r
+	}
+}
+
+// WithCache configures the LookupAsn cache.
+// By default, up to DefaultCacheSize entries are kept in memory
+// for DefaultCacheTTL.
+//
+// Handlers of several processes may share a cache
+// by using the same MongoCache as backend.
+func WithCache(config CacheConfig) HandlerOption {
+	return func(h *Handler) {
+		h.cacheConf = config
+	}
 }
 
 // NewHandler creates a handler
 // for accessing geoipdb features.
 //
 // Parameter overrides, if not nil,
-// is used to access a collection of overrides of ASN descriptions.
-// (See Overrides<...> methods.)
+// is used to access a collection of overrides of ASN descriptions
+// (see Overrides<...> methods, and WithOverrides for other stores).
 //
 // Parameter timeout is honored by methods that access external services.
 // Pass zero to disable timeout.
 //
-// Returns a geoipdb handler.
-func NewHandler(overrides *mgo.Collection, timeout time.Duration) (Handler, error) {
-	ge4, err := geoip.OpenType(geoip.GEOIP_ASNUM_EDITION)
-	if err != nil {
-		return Handler{}, fmt.Errorf("cannot open GeoIP database: %s", err)
+// Further options (see HandlerOption) are applied in order.
+//
+// Returns a geoipdb handler, to be released with Close.
+func NewHandler(overrides *mgo.Collection, timeout time.Duration, opts ...HandlerOption) (Handler, error) {
+	h := Handler{
+		timeout: timeout,
+		flights: &flightGroup{},
+		metrics: newMetrics(),
+		routes:  newRouteTable(),
 	}
-	ge6, err := geoip.OpenType(geoip.GEOIP_ASNUM_EDITION_V6)
-	if err != nil {
-		return Handler{}, fmt.Errorf("cannot open GeoIP database: %s", err)
+	if overrides != nil {
+		h.overrides = NewMongoOverrides(overrides)
+	}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	if h.sources == nil {
+		sources, err := DefaultSources(timeout)
+		if err != nil {
+			return Handler{}, err
+		}
+		h.sources = sources
+		for i, src := range sources {
+			switch s := src.(type) {
+			case *IpInfoSource:
+				if h.ipinfo != nil {
+					sources[i] = h.ipinfo
+				}
+			case *CymruOriginSource:
+				if h.resolver != nil {
+					s.Resolver = h.resolver
+				}
+			case *CymruDnsSource:
+				if h.resolver != nil {
+					s.Resolver = h.resolver
+				}
+			}
+		}
+	}
+	for _, src := range h.sources {
+		switch s := src.(type) {
+		case *LibGeoipSource:
+			if h.libgeoip == nil {
+				h.libgeoip = s
+			}
+		case *MmdbSource:
+			if h.mmdb == nil {
+				h.mmdb = s
+			}
+		case *IpInfoSource:
+			if h.ipinfo == nil {
+				h.ipinfo = s
+			}
+		case *CymruOriginSource:
+			if h.origin == nil {
+				h.origin = s
+			}
+		case *CymruDnsSource:
+			if h.cymru == nil {
+				h.cymru = s
+			}
+		}
 	}
-	cy := newCymruClient(timeout)
-	return Handler{
-		geoip4:    ge4,
-		geoip6:    ge6,
-		cymru:     cy,
-		timeout:   timeout,
-		overrides: overrides,
-		cache:     newCache(),
-	}, nil
+	if h.ipinfo == nil {
+		h.ipinfo = NewIpInfoSource(timeout)
+	}
+	if h.resolver == nil {
+		h.resolver = newDefaultDnsResolver(timeout)
+	}
+	if h.origin == nil {
+		h.origin = &CymruOriginSource{Resolver: h.resolver}
+	}
+	if h.cymru == nil {
+		h.cymru = &CymruDnsSource{Resolver: h.resolver}
+	}
+	if h.whois == nil {
+		h.whois = &CymruWhoisClient{Timeout: timeout}
+	}
+	if h.mirrorInterval > 0 && h.overrides != nil {
+		h.mirror = NewOverridesMirror(h.overrides, h.mirrorInterval)
+		h.overrides = h.mirror
+	}
+	var routes []netip.Prefix
+	if h.routes.store != nil {
+		var err error
+		if routes, err = h.loadRoutes(); err != nil {
+			return Handler{}, err
+		}
+	}
+	h.cache = newCache(h.cacheConf)
+	h.cache.logger = h.logger
+	h.cache.routes = h.routes
+	if path := h.cacheConf.SnapshotPath; path != "" {
+		if err := h.cache.loadSnapshot(path); err != nil {
+			h.logger.log(LogWarn, "cannot load cache snapshot", LogField{"path", path}, LogField{"err", err})
+		}
+	}
+	// Cached data may predate the prefix overrides
+	for _, prefix := range routes {
+		h.purgeRoute(prefix)
+	}
+	if h.routes.store != nil && h.routes.interval > 0 {
+		go h.pollRoutes()
+	}
+	return h, nil
+}
+
+// Close stops the background sweeping of the LookupAsn cache,
+// the refreshes of the overrides mirror (see WithOverridesMirror)
+// and of the prefix overrides (see WithPrefixOverridesRefresh),
+// and saves the cache to CacheConfig.SnapshotPath if set.
+// The Handler remains usable, but expired entries are only
+// dropped when replaced or evicted.
+//
+// Returns an error if the cache snapshot could not be saved.
+func (h Handler) Close() error {
+	if h.mirror != nil {
+		h.mirror.Close()
+	}
+	h.routes.close()
+	return h.cache.close()
 }
 
 // LibGeoipLookup queries the libgeoip database for the ASN of a given ip address.
 //
 // Returns
 // an ASN identification
-// and the corresponding description.
+// and the corresponding description,
+// or empty strings if the Handler has no libgeoip source (see WithSources).
 func (h Handler) LibGeoipLookup(ip string) (string, string) {
-	var name string
-	ipAddr, isIPv4 := iputils.ParseIP(ip)
-	if ipAddr == nil {
+	if h.libgeoip == nil {
 		return "", ""
 	}
-	if isIPv4 {
-		name, _ = h.geoip4.GetName(ip)
-	} else {
-		name, _ = h.geoip6.GetNameV6(ip)
-	}
-	name = strings.TrimSpace(name)
-	if name == "" {
+	info := h.libgeoip.lookup(ip)
+	return info.Asn, info.Descr
+}
+
+// MmdbLookup queries the MaxMind DB for the ASN of a given ip address.
+//
+// Returns
+// an ASN identification
+// and the corresponding description,
+// or empty strings if the Handler has no MaxMind DB source (see WithSources).
+func (h Handler) MmdbLookup(ip string) (string, string) {
+	if h.mmdb == nil {
 		return "", ""
 	}
-	answer := strings.SplitN(name, " ", 2)
-	if len(answer) < 2 {
-		return answer[0], ""
-	}
-	return answer[0], answer[1]
+	info := h.mmdb.lookup(ip)
+	return info.Asn, info.Descr
 }
 
 // LookupAsn searches for the Autonomous System Number (ASN)
 // of a valid IP address.
 //
 // This is the preferred ASN lookup function to be used by clients,
-// as it queries several resources for finding proper answers.
-// Particularly, the overrides collection (see NewHandler)
-// takes precedence for querying ASN descriptions.
+// as it queries several resources for finding proper answers
+// (see WithSources).
+// Particularly, the overrides (see NewHandler and WithOverrides)
+// takes precedence for querying ASN descriptions,
+// and prefix overrides (see WithPrefixOverrides)
+// take precedence over all sources.
 //
-// Data returned by LookupAsn is cached with a 1 day TTL.
+// Data returned by LookupAsn is cached for CacheConfig.TTL
+// (DefaultCacheTTL unless configured by WithCache),
+// or the CacheConfig.SourceTTL of the source which found it.
 // Also see: AsnCachePurge.
 //
 // Returns
 // an ASN identification
 // and the corresponding description.
 func (h Handler) LookupAsn(ip string) (string, string, error) {
+	return h.LookupAsnContext(context.Background(), ip)
+}
+
+// LookupAsnContext is like LookupAsn,
+// but gives up when ctx is done.
+//
+// The deadline of ctx bounds the whole lookup,
+// across all queried sources.
+// If ctx is done before an answer is found,
+// LookupAsnContext returns ctx.Err().
+func (h Handler) LookupAsnContext(ctx context.Context, ip string) (string, string, error) {
+	info, err := h.LookupAsnInfoContext(ctx, ip)
+	return info.Asn, info.Descr, err
+}
+
+// LookupAsnInfo is like LookupAsn,
+// but answers everything known about the ASN of ip,
+// such as the source which found it and the covering prefix.
+func (h Handler) LookupAsnInfo(ip string) (AsnInfo, error) {
+	return h.LookupAsnInfoContext(context.Background(), ip)
+}
+
+// LookupAsnInfoContext is like LookupAsnInfo,
+// but gives up when ctx is done (see LookupAsnContext).
+//
+// IP addresses are looked up and cached in canonical form,
+// so that different spellings of an address share cache entries:
+// IPv4-mapped IPv6 addresses (e.g. "::ffff:1.2.3.4") are looked up
+// as IPv4 addresses.
+//
+// Concurrent cache misses for the same IP address
+// share a single uncached lookup, and its result.
+func (h Handler) LookupAsnInfoContext(ctx context.Context, ip string) (AsnInfo, error) {
 	// Sanity check input
-	ipAddr, _ := iputils.ParseIP(ip)
-	if ipAddr == nil {
-		return "", "", MalformedIPError
+	addr, ok := iputils.ParseAddr(ip)
+	if !ok {
+		return AsnInfo{}, MalformedIPError
 	}
-	if iputils.IsLocalIP(ipAddr) {
-		return "", "", PrivateIPError
+	if iputils.IsLocalAddr(addr) {
+		return AsnInfo{}, PrivateIPError
 	}
 	// Try cache
-	asn, descr, expired, found := h.cache.lookupByIP(ip)
+	info, expired, found, err := h.cache.lookupByIP(addr)
+	h.metrics.cacheLookup(info, expired, found)
 	if found && !expired {
-		return asn, descr, nil
-	}
-	log.Printf("(geoipdb) cache miss for %s\n", ip)
-	// Try uncached lookup
-	var err error
-	asn, descr, err = h.lookupAsnUncached(ip)
-	if err == nil {
-		// Update cache
-		h.cache.store(ip, asn, descr)
-	}
-	return asn, descr, err
-}
-
-// lookupAsnUncached is the uncached version of LookupAsn.
-func (h Handler) lookupAsnUncached(ip string) (string, string, error) {
-	// Try libgeoip
-	asnGi, asnDescr := h.LibGeoipLookup(ip)
-	if asnGi != "" && asnDescr != "" {
-		// libgeoip returned an ASN and description.
-		return asnGi, h.getOverridenDescr(asnGi, asnDescr), nil
-	}
-	if asnGi == "" {
-		log.Printf("warning: libgeoip lookup failed for ip '%s'\n", ip)
-	}
-	// Try ipinfo.io
-	asnDescr = ""
-	asnIp, asnDescr, errIp := h.IpInfoLookup(ip)
-	if errIp == nil {
-		if asnIp != "" && asnDescr != "" {
-			// ipinfo.io returned an ASN and description.
-			return asnIp, h.getOverridenDescr(asnIp, asnDescr), nil
+		return info, err
+	}
+	if found && info.Cache == CacheStale {
+		h.refreshStale(addr)
+		return info, nil
+	}
+	h.logger.log(LogDebug, "cache miss", LogField{"ip", addr.String()})
+	// Try uncached lookup, shared with concurrent misses,
+	// and update cache
+	shared, err := h.flights.do(ctx, addr.String(), func() (interface{}, error) {
+		info, err := h.lookupAsnUncached(ctx, addr)
+		if err != nil {
+			h.cache.storeError(addr, err)
+			return AsnInfo{}, err
 		}
-	} else {
-		log.Printf("warning: ipinfo lookup failed for ip '%s': %s\n", ip, errIp)
-	}
-	var asn string
-	if asnGi != "" {
-		asn = asnGi
-	} else if errIp == nil && asnIp != "" {
-		asn = asnIp
-	} else {
+		return h.cache.store(addr, info), nil
+	})
+	if err != nil {
+		return AsnInfo{}, err
+	}
+	return shared.(AsnInfo), nil
+}
+
+// refreshStale updates in the background
+// the stale cache entry answering ip, unless already being refreshed.
+// The lookup is shared with concurrent misses of ip.
+// On failure, the stale entry is kept.
+func (h Handler) refreshStale(ip netip.Addr) {
+	key, ok := h.cache.claimRefresh(ip)
+	if !ok {
+		return
+	}
+	go func() {
+		defer h.cache.releaseRefresh(key)
+		ctx := context.Background()
+		_, err := h.flights.do(ctx, ip.String(), func() (interface{}, error) {
+			info, err := h.lookupAsnUncached(ctx, ip)
+			if err != nil {
+				return AsnInfo{}, err
+			}
+			return h.cache.store(ip, info), nil
+		})
+		if err != nil {
+			h.logger.log(LogWarn, "cannot refresh stale ASN", LogField{"ip", ip.String()}, LogField{"err", err})
+		}
+	}()
+}
+
+// lookupAsnUncached is the uncached version of LookupAsnInfoContext.
+func (h Handler) lookupAsnUncached(ctx context.Context, ip netip.Addr) (AsnInfo, error) {
+	info, err := h.querySources(ctx, ip.String(), false)
+	if err != nil {
+		return AsnInfo{}, err
+	}
+	h.overrideDescr(ctx, &info)
+	return info, nil
+}
+
+// querySources queries the sources of ASN data in order
+// for the ASN of a given ip address.
+//
+// If deferDescr is true, querySources stops at the first AsnDescriber
+// once an undescribed ASN is found,
+// leaving the description of the ASN to the caller.
+//
+// Returns the ASN data of ip, with description not yet overriden.
+func (h Handler) querySources(ctx context.Context, ip string, deferDescr bool) (AsnInfo, error) {
+	// Prefix overrides take precedence over sources.
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		if override, ok := h.routes.match(addr); ok {
+			if deferDescr {
+				return override.info(), nil
+			}
+			return h.routeInfo(ctx, override), nil
+		}
+	}
+	// Data of the first ASN found by a source which could not describe it.
+	var found AsnInfo
+	// Whether a source answered it does not know the ASN,
+	// else the last source failure.
+	var answered bool
+	var failure error
+	for _, src := range h.sources {
+		if err := ctx.Err(); err != nil {
+			return AsnInfo{}, err
+		}
+		if _, ok := src.(AsnDescriber); ok && deferDescr && found.Asn != "" {
+			break
+		}
+		start := time.Now()
+		info, err := src.LookupAsn(ctx, ip, found.Asn)
+		if err == SourceNotApplicableError {
+			continue
+		}
+		if err == SourceUnknownAsnError || (err == nil && info.Asn == "") {
+			h.metrics.sourceQuery(src.Name(), start, sourceUnknown)
+			answered = true
+			continue
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return AsnInfo{}, ctxErr
+			}
+			h.metrics.sourceQuery(src.Name(), start, sourceFailure)
+			h.logger.warnLimited(src.Name(), "source lookup failed",
+				LogField{"source", src.Name()}, LogField{"ip", ip}, LogField{"err", err})
+			failure = err
+			continue
+		}
+		h.metrics.sourceQuery(src.Name(), start, sourceSuccess)
+		if info.Source == "" {
+			info.Source = src.Name()
+		}
+		if info.Descr != "" {
+			if found.Asn == "" || info.Asn != found.Asn {
+				// Source returned an ASN and description.
+				return info.normalized(), nil
+			}
+			// Source described the ASN found before.
+			found.Descr = info.Descr
+			return found.normalized(), nil
+		}
+		if found.Asn == "" {
+			found = info
+		}
+	}
+	if found.Asn == "" && !answered && failure != nil {
+		// Every source failed: the ASN may still be known.
+		return AsnInfo{}, sourcesFailedError{ip, failure}
+	}
+	if found.Asn == "" {
 		// Cannot find an ASN. Give up.
-		return "", "", fmt.Errorf("unknown ASN for ip '%v'", ip)
+		return AsnInfo{}, unknownAsnError(ip)
 	}
 	// We found an ASN, but no description for it.
-	// Try getting one from cymru's dns service.
-	asnDescr, err := h.CymruDnsLookup(asn)
-	if err != nil {
-		log.Printf("warning: cymru lookup failed for asn '%s': %s\n", asn, err)
-		return asn, h.getOverridenDescr(asn, ""), nil
+	return found.normalized(), nil
+}
+
+// normalized answers a copy of info
+// with fields derived from source data filled in.
+func (info AsnInfo) normalized() AsnInfo {
+	info.Number = asnNumber(info.Asn)
+	info.RawDescr = info.Descr
+	return info
+}
+
+// describeAsn queries the AsnDescriber sources in order
+// for the description of a given ASN.
+//
+// Returns the ASN description, not yet overriden,
+// or an empty string if no source could describe the ASN.
+func (h Handler) describeAsn(ctx context.Context, asn string) string {
+	for _, src := range h.sources {
+		describer, ok := src.(AsnDescriber)
+		if !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ""
+		}
+		start := time.Now()
+		descr, err := describer.DescribeAsn(ctx, asn)
+		if err != nil {
+			h.metrics.sourceQuery(src.Name(), start, sourceFailure)
+			h.logger.warnLimited(src.Name(), "source lookup failed",
+				LogField{"source", src.Name()}, LogField{"asn", asn}, LogField{"err", err})
+			continue
+		}
+		if descr != "" {
+			h.metrics.sourceQuery(src.Name(), start, sourceSuccess)
+			return descr
+		}
+		h.metrics.sourceQuery(src.Name(), start, sourceUnknown)
 	}
-	return asn, h.getOverridenDescr(asn, asnDescr), nil
+	return ""
 }
 
 // IpInfoLookup queries ipinfo.io for the ASN of a given ip address.
@@ -232,33 +668,52 @@ func (h Handler) lookupAsnUncached(ip string) (string, string, error) {
 // an ASN identification
 // and the corresponding description.
 func (h Handler) IpInfoLookup(ip string) (string, string, error) {
-	client := &http.Client{
-		Timeout: h.timeout,
-	}
-	url := fmt.Sprintf("http://ipinfo.io/%s/org", ip)
-	resp, err := client.Get(url)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to GET '%s': %s", url, err)
-	}
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read ipinfo.io response: %s", err)
-	}
-	asnData := strings.TrimSpace(string(data))
-	if asnData == "" {
-		return "", "", fmt.Errorf("GET '%s' returned an empty answer", url)
+	return h.IpInfoLookupContext(context.Background(), ip)
+}
+
+// IpInfoLookupContext is like IpInfoLookup,
+// but gives up when ctx is done.
+func (h Handler) IpInfoLookupContext(ctx context.Context, ip string) (string, string, error) {
+	if h.ipinfo == nil {
+		return "", "", fmt.Errorf("ipinfo source not initialized")
 	}
-	answer := strings.SplitN(asnData, " ", 2)
-	// ipinfo.io returns errors as regular text (no out-of-band error codes).
-	// Let's try to be smart and identify them.
-	if !reASN.MatchString(answer[0]) {
-		return "", "", fmt.Errorf("ipinfo.io lookup failed for '%s': %s", ip, asnData)
+	info, err := h.ipinfo.Lookup(ctx, ip)
+	return info.Asn, info.Org, err
+}
+
+// IpInfoDetails queries ipinfo.io for data about a given ip address,
+// such as its ASN, hostname and location.
+//
+// Returns the ipinfo.io data of ip.
+func (h Handler) IpInfoDetails(ip string) (IpInfo, error) {
+	return h.IpInfoDetailsContext(context.Background(), ip)
+}
+
+// IpInfoDetailsContext is like IpInfoDetails,
+// but gives up when ctx is done.
+func (h Handler) IpInfoDetailsContext(ctx context.Context, ip string) (IpInfo, error) {
+	if h.ipinfo == nil {
+		return IpInfo{}, fmt.Errorf("ipinfo source not initialized")
 	}
-	if len(answer) < 2 {
-		return answer[0], "", nil
+	return h.ipinfo.Lookup(ctx, ip)
+}
+
+// CymruOriginLookup performs a query to Team Cymru's DNS service
+// for the origin ASNs of a given ip address,
+// along with the covering BGP prefix and its registration data.
+//
+// Returns the origin data of ip.
+func (h Handler) CymruOriginLookup(ip string) (CymruOrigin, error) {
+	return h.CymruOriginLookupContext(context.Background(), ip)
+}
+
+// CymruOriginLookupContext is like CymruOriginLookup,
+// but gives up when ctx is done.
+func (h Handler) CymruOriginLookupContext(ctx context.Context, ip string) (CymruOrigin, error) {
+	if h.origin == nil {
+		return CymruOrigin{}, fmt.Errorf("cymru origin source not initialized")
 	}
-	return answer[0], answer[1], nil
+	return cymruClient{h.origin.Resolver}.lookupOrigin(ctx, ip)
 }
 
 // CymruDnsLookup performs a query to Team Cymru's DNS service
@@ -266,81 +721,112 @@ func (h Handler) IpInfoLookup(ip string) (string, string, error) {
 //
 // Returns the ASN description.
 func (h Handler) CymruDnsLookup(asn string) (string, error) {
-	return h.cymru.lookup(asn)
-}
-
-// cymruClient can do DNS queries to Team Cymru's database
-// for retrieving ASN descriptions.
-type cymruClient struct {
-	dnsClient *dns.Client
-	reFilter  *regexp.Regexp
+	return h.CymruDnsLookupContext(context.Background(), asn)
 }
 
-// newCymruClient creates an initialized cymruClient.
-func newCymruClient(timeout time.Duration) cymruClient {
-	c := new(dns.Client)
-	c.Timeout = timeout
-	return cymruClient{
-		dnsClient: c,
-		reFilter:  reDNSFilter.Copy(),
+// CymruDnsLookupContext is like CymruDnsLookup,
+// but gives up when ctx is done.
+func (h Handler) CymruDnsLookupContext(ctx context.Context, asn string) (string, error) {
+	if h.cymru == nil {
+		return "", fmt.Errorf("cymru source not initialized")
 	}
+	return h.cymru.DescribeAsn(ctx, asn)
 }
 
-// lookup retrieves the description of a given ASN
-// by reaching Team Cymru's DNS database.
+// CymruWhoisLookup maps a list of IP addresses to ASNs
+// in a single bulk query to Team Cymru's whois service
+// (see WithCymruWhois).
 //
-// Returns the ASN description.
-func (cc cymruClient) lookup(asn string) (string, error) {
-	if asn == "" {
-		return "", fmt.Errorf("empty asn parameter")
-	}
-	if cc.dnsClient == nil {
-		return "", fmt.Errorf("cymruClient not initialized")
-	}
-	msg := new(dns.Msg)
-	msg.Id = dns.Id()
-	msg.RecursionDesired = true
-	msg.Question = make([]dns.Question, 1)
-	msg.Question[0] = dns.Question{
-		Name:   asn + ".asn.cymru.com.",
-		Qtype:  dns.TypeTXT,
-		Qclass: dns.ClassINET,
-	}
-	// Send query to Google public dns server
-	msg, _, err := cc.dnsClient.Exchange(msg, "8.8.8.8:53")
+// This is meant for mapping many IP addresses at once.
+// ASN descriptions are overriden like LookupAsn does,
+// and results are stored in the LookupAsn cache.
+// IP addresses of prefix overrides (see WithPrefixOverrides)
+// are answered by the override, as LookupAsn does.
+//
+// Returns
+// a result per IP address, in the same order as ips,
+// or an error if the bulk query failed as a whole.
+func (h Handler) CymruWhoisLookup(ips []string) ([]BatchResult, error) {
+	return h.CymruWhoisLookupContext(context.Background(), ips)
+}
+
+// CymruWhoisLookupContext is like CymruWhoisLookup,
+// but gives up when ctx is done.
+func (h Handler) CymruWhoisLookupContext(ctx context.Context, ips []string) ([]BatchResult, error) {
+	start := time.Now()
+	results, err := h.whois.Lookup(ctx, ips)
 	if err != nil {
-		return "", fmt.Errorf("failed to query dns: %s", err)
+		h.metrics.sourceQuery("cymru-whois", start, sourceFailure)
+		return nil, err
 	}
-	for _, ans := range msg.Answer {
-		if t, ok := ans.(*dns.TXT); ok {
-			return strings.TrimSpace(cc.reFilter.ReplaceAllString(t.Txt[0], "")), nil
+	h.metrics.sourceQuery("cymru-whois", start, sourceSuccess)
+	// Overriden results, by ASN and original description
+	overriden := make(map[[2]string]AsnInfo)
+	// Answers of prefix overrides, by prefix
+	routed := make(map[string]AsnInfo)
+	for i, r := range results {
+		addr, _ := iputils.ParseAddr(r.IP)
+		// Prefix overrides take precedence over whois.
+		if override, ok := h.routes.match(addr); ok && !iputils.IsLocalAddr(addr) {
+			info, ok := routed[override.Prefix]
+			if !ok {
+				info = h.routeInfo(ctx, override)
+				h.overrideDescr(ctx, &info)
+				routed[override.Prefix] = info
+			}
+			results[i].AsnInfo, results[i].Err = h.cache.store(addr, info), nil
+			continue
 		}
+		if r.Err != nil {
+			h.cache.storeError(addr, r.Err)
+			continue
+		}
+		key := [2]string{r.Asn, r.Descr}
+		o, ok := overriden[key]
+		if !ok {
+			o = r.AsnInfo
+			h.overrideDescr(ctx, &o)
+			overriden[key] = o
+		}
+		r.Descr, r.RawDescr, r.Overriden = o.Descr, o.RawDescr, o.Overriden
+		results[i].AsnInfo = h.cache.store(addr, r.AsnInfo)
 	}
-	return "", fmt.Errorf("not yet implemented")
+	return results, nil
 }
 
-// getOverridenDescr answers the ASN description
-// taken from the override collection, if found.
-// Otherwise, answers the fallback parameter.
-func (h Handler) getOverridenDescr(asn string, fallback string) string {
-	descr, err := h.OverridesLookup(asn)
+// overrideDescr replaces the ASN description of info
+// by the one taken from the override collection, if found.
+func (h Handler) overrideDescr(ctx context.Context, info *AsnInfo) {
+	if info.Overriden {
+		// Described by a prefix override
+		return
+	}
+	info.RawDescr = info.Descr
+	descr, err := h.OverridesLookupContext(ctx, info.Asn)
+	if err != OverridesNilCollectionError {
+		h.metrics.override(err == nil)
+	}
 	if err != nil {
 		if err != OverridesNilCollectionError && err != OverridesAsnNotFoundError {
-			log.Printf("warning: %s\n", err)
+			h.logger.log(LogWarn, "overrides lookup failed", LogField{"asn", info.Asn}, LogField{"err", err})
 		}
-		return fallback
+		return
 	}
-	return descr
+	info.Descr = descr
+	info.Overriden = true
 }
 
 // AsnCachePurge erases all LookupAsn cached data.
 func (h Handler) AsnCachePurge() {
-	log.Println("(geoipdb) cache purge")
+	h.logger.log(LogInfo, "cache purge")
 	h.cache.purgeAll()
 }
 
 // LookupIp searches the cache
-// for all IP addresses associated with a given ASN.
+// for all IP addresses associated with a given ASN,
+// in canonical form.
+// Only addresses whose lookup reached the sources are listed:
+// other addresses of a cached prefix are answered but not recorded.
 //
 // Returns a non nil list of IP addresses.
 func (h Handler) LookupIp(asn string) []string {
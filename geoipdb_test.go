@@ -192,6 +192,47 @@ func TestNewHandlerWithOverrides(t *testing.T) {
 	}
 }
 
+func TestMongoCacheShared(t *testing.T) {
+	backend, err := geoipdb.NewMongoCache(mgD.C(mgCollection+"_cache"), time.Second*5)
+	if err != nil {
+		t.Fatalf("NewMongoCache failed: %s", err)
+	}
+	backend.PurgeAll()
+	// Two replicas sharing the cache
+	src := &fakeSource{name: "fake", asn: "AS13335", descr: "CLOUDFLARENET", prefix: "1.0.0.0/24"}
+	var replicas [2]geoipdb.Handler
+	for i := range replicas {
+		replicas[i], err = geoipdb.NewHandler(mgC, time.Second*5,
+			geoipdb.WithSources(src),
+			geoipdb.WithCache(geoipdb.CacheConfig{Backend: backend}))
+		if err != nil {
+			t.Fatalf("cannot create geoipdb handler: %s", err)
+		}
+	}
+	if _, _, err := replicas[0].LookupAsn("1.0.0.1"); err != nil {
+		t.Fatalf("LookupAsn failed: %s", err)
+	}
+	info, err := replicas[1].LookupAsnInfo("1.0.0.2")
+	if err != nil || info.Cache != geoipdb.CacheHit || info.Asn != "AS13335" {
+		t.Fatalf("unexpected LookupAsnInfo result of other replica: %+v %v", info, err)
+	}
+	if ips := replicas[1].LookupIp("AS13335"); !reflect.DeepEqual(ips, []string{"1.0.0.1"}) {
+		t.Fatalf("unexpected LookupIp result of other replica: %v", ips)
+	}
+	// Setting an override purges the cache of all replicas.
+	if err := replicas[0].OverridesSet("AS13335", "Cloudflare"); err != nil {
+		t.Fatalf("OverridesSet failed: %s", err)
+	}
+	defer replicas[0].OverridesRemove("AS13335")
+	info, err = replicas[1].LookupAsnInfo("1.0.0.2")
+	if err != nil || info.Cache != geoipdb.CacheMiss || info.Descr != "Cloudflare" {
+		t.Fatalf("unexpected LookupAsnInfo result after override: %+v %v", info, err)
+	}
+	if len(src.hints) != 2 {
+		t.Fatalf("unexpected number of source queries: %d", len(src.hints))
+	}
+}
+
 func TestOverridesListEmpty(t *testing.T) {
 	overrides, err := gh.OverridesList()
 	if err != nil {
@@ -316,6 +357,31 @@ func TestIsLocalIP(t *testing.T) {
 	}
 }
 
+func TestParseAddr(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":         "1.2.3.4",
+		"::ffff:1.2.3.4":  "1.2.3.4",
+		"2001:DB8:0::1":   "2001:db8::1",
+		"2404:6800::0064": "2404:6800::64",
+		"1.2.3":           "",
+		"fe80::1%eth0":    "",
+		"":                "",
+	}
+	for ip, expected := range tests {
+		addr, ok := iputils.ParseAddr(ip)
+		if ok != (expected != "") || ok && addr.String() != expected {
+			t.Fatalf("unexpected ParseAddr(%s) result: %s %v", ip, addr, ok)
+		}
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		addr, _ := iputils.ParseAddr("2404:6800:4003:c01::64")
+		iputils.IsLocalAddr(addr)
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected allocations: %v", allocs)
+	}
+}
+
 func TestLookupAsnMalformedIP(t *testing.T) {
 	ip := "192.168.0"
 	_, _, err := gh.LookupAsn(ip)
@@ -0,0 +1,214 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultIpInfoURL is the base URL of the ipinfo.io service.
+const DefaultIpInfoURL = "https://ipinfo.io"
+
+var (
+	// IpInfoRateLimitError is returned by ipinfo.io lookups
+	// when the service answers HTTP 429 (Too Many Requests).
+	IpInfoRateLimitError = errors.New("ipinfo.io rate limit exceeded")
+	// IpInfoForbiddenError is returned by ipinfo.io lookups
+	// when the service answers HTTP 403 (Forbidden),
+	// e.g. for an invalid token.
+	IpInfoForbiddenError = errors.New("ipinfo.io access forbidden")
+)
+
+// IpInfo is what ipinfo.io knows about an IP address.
+type IpInfo struct {
+	IP string `json:"ip"`
+	// ASN identification
+	Asn string `json:"asn"`
+	// Organization owning the ASN, i.e. the ASN description
+	Org      string `json:"org"`
+	Hostname string `json:"hostname"`
+	City     string `json:"city"`
+	Region   string `json:"region"`
+	// Country code
+	Country string `json:"country"`
+	// Latitude and longitude, comma separated
+	Loc      string `json:"loc"`
+	Timezone string `json:"timezone"`
+	// Prefix announcing the IP address, on plans that provide it
+	Route string `json:"route"`
+}
+
+// ipInfoReply is the JSON reply of ipinfo.io.
+type ipInfoReply struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	City     string `json:"city"`
+	Region   string `json:"region"`
+	Country  string `json:"country"`
+	Loc      string `json:"loc"`
+	Timezone string `json:"timezone"`
+	// ASN and description, e.g. "AS15169 Google LLC"
+	Org string `json:"org"`
+	// ASN details, on plans that provide them
+	Asn *struct {
+		Asn   string `json:"asn"`
+		Name  string `json:"name"`
+		Route string `json:"route"`
+	} `json:"asn"`
+	Error *struct {
+		Title   string `json:"title"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// IpInfoSource is an AsnSource backed by the ipinfo.io service.
+type IpInfoSource struct {
+	// BaseURL is the base URL of the service.
+	// Empty means DefaultIpInfoURL.
+	BaseURL string
+	// Token is the API token of the service.
+	// Empty means anonymous access.
+	Token string
+	// Client sends the requests to the service.
+	// Nil means http.DefaultClient.
+	Client *http.Client
+}
+
+// NewIpInfoSource creates an IpInfoSource
+// for anonymous access to DefaultIpInfoURL.
+//
+// Parameter timeout limits the duration of each query.
+// Pass zero to disable timeout.
+func NewIpInfoSource(timeout time.Duration) *IpInfoSource {
+	return &IpInfoSource{
+		Client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// Name implements AsnSource.
+func (s *IpInfoSource) Name() string {
+	return "ipinfo"
+}
+
+// LookupAsn implements AsnSource.
+func (s *IpInfoSource) LookupAsn(ctx context.Context, ip string, _ string) (AsnInfo, error) {
+	info, err := s.Lookup(ctx, ip)
+	if err != nil {
+		return AsnInfo{}, err
+	}
+	return AsnInfo{
+		Asn:     info.Asn,
+		Descr:   info.Org,
+		Prefix:  info.Route,
+		Country: info.Country,
+	}, nil
+}
+
+// Lookup queries ipinfo.io for data about a given ip address.
+// The query is abandoned when ctx is done.
+//
+// Returns
+// the ipinfo.io data of ip,
+// IpInfoRateLimitError or IpInfoForbiddenError if the service refused the query,
+// or SourceUnknownAsnError if the service does not know the ASN of ip.
+func (s *IpInfoSource) Lookup(ctx context.Context, ip string) (IpInfo, error) {
+	baseURL := s.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultIpInfoURL
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	url := fmt.Sprintf("%s/%s/json", strings.TrimRight(baseURL, "/"), ip)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return IpInfo{}, fmt.Errorf("failed to GET '%s': %s", url, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return IpInfo{}, fmt.Errorf("failed to GET '%s': %s", url, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return IpInfo{}, IpInfoRateLimitError
+	case http.StatusForbidden:
+		return IpInfo{}, IpInfoForbiddenError
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return IpInfo{}, fmt.Errorf("failed to read ipinfo.io response: %s", err)
+	}
+	var reply ipInfoReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return IpInfo{}, fmt.Errorf("GET '%s' returned %s", url, resp.Status)
+		}
+		return IpInfo{}, fmt.Errorf("failed to parse ipinfo.io response: %s", err)
+	}
+	if reply.Error != nil {
+		return IpInfo{}, fmt.Errorf("ipinfo.io lookup failed for '%s': %s: %s", ip, reply.Error.Title, reply.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return IpInfo{}, fmt.Errorf("GET '%s' returned %s", url, resp.Status)
+	}
+	info := IpInfo{
+		IP:       reply.IP,
+		Hostname: reply.Hostname,
+		City:     reply.City,
+		Region:   reply.Region,
+		Country:  reply.Country,
+		Loc:      reply.Loc,
+		Timezone: reply.Timezone,
+	}
+	if reply.Asn != nil && reply.Asn.Asn != "" {
+		info.Asn, info.Org, info.Route = reply.Asn.Asn, reply.Asn.Name, reply.Asn.Route
+	} else {
+		answer := strings.SplitN(strings.TrimSpace(reply.Org), " ", 2)
+		info.Asn = answer[0]
+		if len(answer) > 1 {
+			info.Org = answer[1]
+		}
+	}
+	if !reASN.MatchString(info.Asn) {
+		return IpInfo{}, SourceUnknownAsnError
+	}
+	return info, nil
+}
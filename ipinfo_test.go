@@ -0,0 +1,155 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/geoipdb"
+)
+
+// ipInfoReplies are sample ipinfo.io JSON replies, by request path.
+var ipInfoReplies = map[string]string{
+	"/8.8.8.8/json": `{
+  "ip": "8.8.8.8",
+  "hostname": "dns.google",
+  "city": "Mountain View",
+  "region": "California",
+  "country": "US",
+  "loc": "37.4056,-122.0775",
+  "org": "AS15169 Google LLC",
+  "postal": "94043",
+  "timezone": "America/Los_Angeles"
+}`,
+	"/1.0.0.1/json": `{
+  "ip": "1.0.0.1",
+  "hostname": "one.one.one.one",
+  "country": "AU",
+  "org": "AS13335 Cloudflare, Inc.",
+  "asn": {"asn": "AS13335", "name": "Cloudflare, Inc.", "route": "1.0.0.0/24"}
+}`,
+	"/45.45.45.45/json": `{"ip": "45.45.45.45", "country": "US"}`,
+	"/bogus/json":       `{"error": {"title": "Wrong ip", "message": "Please provide a valid IP address"}}`,
+}
+
+// startIpInfoServer runs a local ipinfo.io stand-in until the test ends.
+// Requests authenticated by token "limited" are rate limited,
+// and requests with other tokens but "secret" are forbidden.
+func startIpInfoServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "", "Bearer secret":
+		case "Bearer limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		reply, ok := ipInfoReplies[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if strings.Contains(reply, `"error"`) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(reply))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestIpInfoSourceLookup(t *testing.T) {
+	server := startIpInfoServer(t)
+	src := &geoipdb.IpInfoSource{BaseURL: server.URL, Token: "secret", Client: server.Client()}
+	info, err := src.Lookup(context.Background(), "8.8.8.8")
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	expected := geoipdb.IpInfo{
+		IP:       "8.8.8.8",
+		Asn:      "AS15169",
+		Org:      "Google LLC",
+		Hostname: "dns.google",
+		City:     "Mountain View",
+		Region:   "California",
+		Country:  "US",
+		Loc:      "37.4056,-122.0775",
+		Timezone: "America/Los_Angeles",
+	}
+	if info != expected {
+		t.Fatalf("unexpected Lookup result: %+v", info)
+	}
+	info, err = src.Lookup(context.Background(), "1.0.0.1")
+	if err != nil || info.Asn != "AS13335" || info.Org != "Cloudflare, Inc." {
+		t.Fatalf("unexpected Lookup result: %+v %v", info, err)
+	}
+	for _, ip := range []string{"45.45.45.45", "bogus", "9.9.9.9"} {
+		if _, err := src.Lookup(context.Background(), ip); err == nil {
+			t.Fatalf("Lookup(\"%s\") did not fail", ip)
+		}
+	}
+}
+
+func TestIpInfoSourceErrors(t *testing.T) {
+	server := startIpInfoServer(t)
+	tests := map[string]error{
+		"limited": geoipdb.IpInfoRateLimitError,
+		"invalid": geoipdb.IpInfoForbiddenError,
+	}
+	for token, expected := range tests {
+		src := &geoipdb.IpInfoSource{BaseURL: server.URL, Token: token}
+		_, err := src.LookupAsn(context.Background(), "8.8.8.8", "")
+		if err != expected {
+			t.Fatalf("unexpected LookupAsn error with token '%s': %v", token, err)
+		}
+	}
+}
+
+func TestIpInfoLookupWithIpInfo(t *testing.T) {
+	server := startIpInfoServer(t)
+	src := geoipdb.NewIpInfoSource(time.Second)
+	src.BaseURL = server.URL
+	h, err := geoipdb.NewHandler(nil, time.Second, geoipdb.WithSources(), geoipdb.WithIpInfo(src))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	asn, descr, err := h.IpInfoLookup("8.8.8.8")
+	if err != nil || asn != "AS15169" || descr != "Google LLC" {
+		t.Fatalf("unexpected IpInfoLookup result: %s %s %v", asn, descr, err)
+	}
+	info, err := h.IpInfoDetails("1.0.0.1")
+	if err != nil || info.Hostname != "one.one.one.one" {
+		t.Fatalf("unexpected IpInfoDetails result: %+v %v", info, err)
+	}
+}
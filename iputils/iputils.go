@@ -27,31 +27,24 @@ package iputils
 
 import (
 	"net"
+	"net/netip"
 )
 
 func init() {
-	// Initialize nonGlobalIPv*Nets
-	nonGlobalIPv4Nets = make([]*net.IPNet, len(nonGlobalIPv4CIDRs))
+	// Initialize nonGlobalIPv*Prefixes
+	nonGlobalIPv4Prefixes = make([]netip.Prefix, len(nonGlobalIPv4CIDRs))
 	for i, cidr := range nonGlobalIPv4CIDRs {
-		_, inet, err := net.ParseCIDR(cidr)
-		if err != nil {
-			panic(err)
-		}
-		nonGlobalIPv4Nets[i] = inet
+		nonGlobalIPv4Prefixes[i] = netip.MustParsePrefix(cidr)
 	}
-	nonGlobalIPv6Nets = make([]*net.IPNet, len(nonGlobalIPv6CIDRs))
+	nonGlobalIPv6Prefixes = make([]netip.Prefix, len(nonGlobalIPv6CIDRs))
 	for i, cidr := range nonGlobalIPv6CIDRs {
-		_, inet, err := net.ParseCIDR(cidr)
-		if err != nil {
-			panic(err)
-		}
-		nonGlobalIPv6Nets[i] = inet
+		nonGlobalIPv6Prefixes[i] = netip.MustParsePrefix(cidr)
 	}
 }
 
 var (
-	nonGlobalIPv4Nets []*net.IPNet
-	nonGlobalIPv6Nets []*net.IPNet
+	nonGlobalIPv4Prefixes []netip.Prefix
+	nonGlobalIPv6Prefixes []netip.Prefix
 )
 
 // nonGlobalIPv4CIDRs contains IANA IPv4 Special-Purpose Address Registry,
@@ -94,24 +87,25 @@ var nonGlobalIPv6CIDRs = []string{
 
 // IsLocalIP tells if an IP address is not forwardable across networks.
 func IsLocalIP(ip net.IP) bool {
-	if ip == nil {
+	addr, ok := netip.AddrFromSlice(ip)
+	return !ok || IsLocalAddr(addr.Unmap())
+}
+
+// IsLocalAddr is like IsLocalIP, for a netip.Addr.
+// IPv4-mapped IPv6 addresses are checked as IPv6 addresses:
+// see ParseAddr for unmapping them.
+// IsLocalAddr does not allocate.
+func IsLocalAddr(addr netip.Addr) bool {
+	if !addr.IsValid() {
 		return true
 	}
-	ip4 := ip.To4()
-	if ip4 != nil {
-		for _, inet := range nonGlobalIPv4Nets {
-			if inet.Contains(ip4) {
-				return true
-			}
-		}
-		return false
+	prefixes := nonGlobalIPv6Prefixes
+	if addr.Is4() {
+		prefixes = nonGlobalIPv4Prefixes
 	}
-	ip6 := ip.To16()
-	if ip6 != nil {
-		for _, inet := range nonGlobalIPv6Nets {
-			if inet.Contains(ip6) {
-				return true
-			}
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
 		}
 	}
 	return false
@@ -143,3 +137,19 @@ func ParseIP(s string) (ip net.IP, isIPv4 bool) {
 	isIPv4 = ip.To4() != nil
 	return
 }
+
+// ParseAddr parses an IP address into its canonical netip.Addr form,
+// IPv4-mapped IPv6 addresses being unmapped to IPv4.
+// Addresses with a zone are rejected.
+// ParseAddr does not allocate.
+//
+// Returns
+// the address,
+// and if it is valid.
+func ParseAddr(s string) (addr netip.Addr, ok bool) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
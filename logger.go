@@ -0,0 +1,204 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	// LogDebug is for routine events, such as cache misses.
+	LogDebug LogLevel = iota
+	// LogInfo is for notable events, such as cache purges.
+	LogInfo
+	// LogWarn is for failures the Handler recovers from,
+	// such as failed source queries.
+	LogWarn
+	// LogError is for failures the Handler cannot recover from.
+	LogError
+)
+
+// String answers the name of level.
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// LogField is a named value attached to a log message,
+// such as "ip", "asn", "source" or "err".
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the log messages of a Handler (see WithLogger).
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// NopLogger is a Logger discarding all messages,
+// and the default one.
+type NopLogger struct{}
+
+// Log implements Logger.
+func (NopLogger) Log(level LogLevel, msg string, fields ...LogField) {}
+
+// SlogLogger is a Logger writing to a log/slog logger.
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger writing to l,
+// or to slog.Default() if l is nil:
+//
+//	h, err := geoipdb.NewHandler(overrides, timeout,
+//		geoipdb.WithLogger(geoipdb.NewSlogLogger(slog.Default())))
+func NewSlogLogger(l *slog.Logger) SlogLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return SlogLogger{Logger: l}
+}
+
+// Log implements Logger.
+func (s SlogLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	var slogLevel slog.Level
+	switch level {
+	case LogDebug:
+		slogLevel = slog.LevelDebug
+	case LogInfo:
+		slogLevel = slog.LevelInfo
+	case LogWarn:
+		slogLevel = slog.LevelWarn
+	default:
+		slogLevel = slog.LevelError
+	}
+	ctx := context.Background()
+	if !s.Logger.Enabled(ctx, slogLevel) {
+		return
+	}
+	attrs := make([]slog.Attr, len(fields))
+	for i, field := range fields {
+		attrs[i] = slog.Any(field.Key, field.Value)
+	}
+	s.Logger.LogAttrs(ctx, slogLevel, msg, attrs...)
+}
+
+// WithLogger defines where the Handler logs to.
+// By default, nothing is logged.
+//
+// Warnings about failures of a given source are rate limited
+// to one per minute, reporting the number of warnings suppressed meanwhile
+// in a "suppressed" field.
+func WithLogger(l Logger) HandlerOption {
+	return func(h *Handler) {
+		h.logger = newLogger(l, logWarningInterval)
+	}
+}
+
+// logWarningInterval is the minimum period between rate limited warnings
+// of the same key.
+const logWarningInterval = time.Minute
+
+// logger wraps the Logger of a Handler, rate limiting some warnings.
+// Its methods are safe for concurrent use,
+// and do nothing on a nil *logger.
+type logger struct {
+	Logger
+	interval time.Duration
+	// Concurrent access control to limits
+	mu sync.Mutex
+	// Rate limits, by key
+	limits map[string]*logLimit
+}
+
+// logLimit is the rate limit state of a key.
+type logLimit struct {
+	// Date of the last warning logged
+	last time.Time
+	// Number of warnings suppressed since
+	suppressed int
+}
+
+// newLogger returns a logger writing to l,
+// with at most one rate limited warning per key and interval.
+func newLogger(l Logger, interval time.Duration) *logger {
+	if l == nil {
+		l = NopLogger{}
+	}
+	return &logger{Logger: l, interval: interval, limits: make(map[string]*logLimit)}
+}
+
+// log logs a message.
+func (l *logger) log(level LogLevel, msg string, fields ...LogField) {
+	if l == nil {
+		return
+	}
+	l.Log(level, msg, fields...)
+}
+
+// warnLimited logs a warning, unless a warning of the same key
+// was logged less than the rate limit interval ago.
+func (l *logger) warnLimited(key string, msg string, fields ...LogField) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	limit, ok := l.limits[key]
+	if !ok {
+		limit = &logLimit{}
+		l.limits[key] = limit
+	}
+	if ok && now.Sub(limit.last) < l.interval {
+		limit.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := limit.suppressed
+	limit.last, limit.suppressed = now, 0
+	l.mu.Unlock()
+	if suppressed > 0 {
+		fields = append(fields, LogField{"suppressed", suppressed})
+	}
+	l.Log(LogWarn, msg, fields...)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/turbobytes/geoipdb"
+)
+
+// recordLogger is a Logger recording messages.
+type recordLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordLogger) Log(level geoipdb.LogLevel, msg string, fields ...geoipdb.LogField) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, field := range fields {
+		msg += fmt.Sprintf(" %s=%v", field.Key, field.Value)
+	}
+	l.messages = append(l.messages, level.String()+" "+msg)
+}
+
+func TestLogger(t *testing.T) {
+	l := &recordLogger{}
+	failing := &fakeSource{name: "failing", err: errors.New("boom")}
+	src := &fakeSource{name: "fake", asn: "AS13335", descr: "CLOUDFLARENET"}
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(failing, src), geoipdb.WithLogger(l))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	for _, ip := range []string{"1.0.0.1", "1.0.0.2", "1.0.0.3"} {
+		if _, _, err := h.LookupAsn(ip); err != nil {
+			t.Fatalf("LookupAsn failed: %s", err)
+		}
+	}
+	h.AsnCachePurge()
+	expected := []string{
+		"debug cache miss ip=1.0.0.1",
+		"warn source lookup failed source=failing ip=1.0.0.1 err=boom",
+		"debug cache miss ip=1.0.0.2",
+		"debug cache miss ip=1.0.0.3",
+		"info cache purge",
+	}
+	if strings.Join(l.messages, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected log messages:\n%s", strings.Join(l.messages, "\n"))
+	}
+}
+
+func TestLogSlog(t *testing.T) {
+	var buf bytes.Buffer
+	l := geoipdb.NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	l.Log(geoipdb.LogDebug, "cache miss", geoipdb.LogField{Key: "ip", Value: "1.0.0.1"})
+	l.Log(geoipdb.LogWarn, "source lookup failed", geoipdb.LogField{Key: "source", Value: "fake"}, geoipdb.LogField{Key: "err", Value: errors.New("boom")})
+	if out := buf.String(); strings.Contains(out, "cache miss") || !strings.Contains(out, `level=WARN msg="source lookup failed" source=fake err=boom`) {
+		t.Fatalf("unexpected slog output: %s", out)
+	}
+}
@@ -0,0 +1,494 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"container/heap"
+	"container/list"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default maximum number of cache entries.
+const DefaultCacheSize = 100000
+
+// DefaultCacheSweepInterval is the default period
+// of the sweeps of expired cache entries.
+const DefaultCacheSweepInterval = time.Minute * 10
+
+// memoryCacheShards is the number of lock shards of a MemoryCache.
+const memoryCacheShards = 64
+
+// memoryShardMinEntries is the minimum share of the maximum size
+// of a MemoryCache per shard: smaller caches have fewer shards.
+const memoryShardMinEntries = 1024
+
+// Prefixes of at least these lengths are stored in the shard
+// of their covering /16 (IPv4) or /32 (IPv6) bucket.
+// Shorter prefixes are stored in a dedicated shard.
+const (
+	bucketOnes4 = 16
+	bucketOnes6 = 32
+)
+
+// MemoryCache is a CacheBackend keeping entries in memory,
+// and the default one.
+//
+// It keeps a bounded number of entries, evicting the least recently used,
+// and removes entries past due in the background until closed.
+//
+// Entries are spread over shards by a hash of the bucket of their prefix,
+// so that all prefixes containing an IP address are in two shards at most:
+// the one of the bucket of the IP address, and the one of short prefixes.
+// Each shard has its own lock, LRU list and share of the maximum size.
+type MemoryCache struct {
+	// Shards of prefixes at least as long as a bucket
+	shards []*memShard
+	// Shard of prefixes shorter than a bucket
+	wide *memShard
+	// Closed to stop the janitor
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// memShard is a shard of a MemoryCache.
+type memShard struct {
+	// Concurrent access control to maps
+	mu sync.RWMutex
+	// Prefix to *memEntry
+	prefixes *prefixTable
+	// ASN to positive entries, by prefix
+	asn map[string]map[string]*memEntry
+	// Entries, most recently used first
+	lru *list.List
+	// Entries, earliest due first
+	expiry expiryHeap
+	// Maximum number of entries, or zero for no limit
+	maxEntries int
+	// Number of evicted entries
+	evictions uint64
+}
+
+// memEntry is a MemoryCache entry.
+//
+// Every entry is in the prefix table, the LRU list, the expiry heap
+// and, unless negative, the ASN map of its shard,
+// and is removed from all of them at once.
+// The ASN map is found from the ASN of the entry,
+// so that removal costs O(1).
+type memEntry struct {
+	// Cached data, without IP addresses
+	CacheEntry
+	// IP addresses looked up within Prefix
+	ips map[string]interface{}
+	// Position in the LRU list
+	elem *list.Element
+	// Position in the expiry heap
+	index int
+}
+
+// expiryHeap orders cache entries by due date, earliest first.
+type expiryHeap []*memEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].Due.Before(h[j].Due) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*memEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// NewMemoryCache creates an empty MemoryCache.
+//
+// Parameter maxEntries is the maximum number of cached prefixes,
+// enforced per shard, hence approximately.
+// Zero means DefaultCacheSize, and a negative value no limit.
+//
+// Parameter sweepInterval is the period of the removal of entries past due.
+// Zero means DefaultCacheSweepInterval,
+// and a negative value disables sweeping.
+func NewMemoryCache(maxEntries int, sweepInterval time.Duration) *MemoryCache {
+	return newMemoryCache(maxEntries, sweepInterval, memoryCacheShards)
+}
+
+// newMemoryCache is NewMemoryCache with a given number of shards.
+func newMemoryCache(maxEntries int, sweepInterval time.Duration, shards int) *MemoryCache {
+	if maxEntries == 0 {
+		maxEntries = DefaultCacheSize
+	} else if maxEntries < 0 {
+		maxEntries = 0
+	}
+	if maxEntries > 0 && maxEntries/shards < memoryShardMinEntries {
+		shards = maxEntries / memoryShardMinEntries
+		if shards < 1 {
+			shards = 1
+		}
+	}
+	// Share of each shard, rounded up
+	perShard := (maxEntries + shards - 1) / shards
+	m := &MemoryCache{
+		shards: make([]*memShard, shards),
+		wide:   newMemShard(perShard),
+		stop:   make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = newMemShard(perShard)
+	}
+	if sweepInterval == 0 {
+		sweepInterval = DefaultCacheSweepInterval
+	}
+	if sweepInterval > 0 {
+		go m.janitor(sweepInterval)
+	}
+	return m
+}
+
+// newMemShard returns an empty shard of a given maximum size.
+func newMemShard(maxEntries int) *memShard {
+	return &memShard{
+		prefixes:   newPrefixTable(),
+		asn:        make(map[string]map[string]*memEntry),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+	}
+}
+
+// bucketShard returns the shard of the bucket of an IP address.
+// It does not allocate.
+func (m *MemoryCache) bucketShard(ip netip.Addr) *memShard {
+	bucket := ip.As16()
+	var bytes []byte
+	if ip.Is4() {
+		bytes = bucket[12 : 12+bucketOnes4/8]
+	} else {
+		bytes = bucket[:bucketOnes6/8]
+	}
+	// FNV-1a hash of the bucket
+	h := uint32(2166136261)
+	for _, b := range bytes {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return m.shards[h%uint32(len(m.shards))]
+}
+
+// prefixShard returns the shard of a prefix.
+func (m *MemoryCache) prefixShard(prefix *net.IPNet) *memShard {
+	ones, bits := prefix.Mask.Size()
+	if bits == 8*net.IPv4len && ones < bucketOnes4 || bits == 8*net.IPv6len && ones < bucketOnes6 {
+		return m.wide
+	}
+	ip, _ := netip.AddrFromSlice(prefix.IP)
+	return m.bucketShard(ip.Unmap())
+}
+
+// all returns all the shards of m.
+func (m *MemoryCache) all() []*memShard {
+	return append([]*memShard{m.wide}, m.shards...)
+}
+
+// janitor sweeps entries past due every interval until m is closed.
+func (m *MemoryCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sweep(time.Now())
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sweep removes the entries due before a given date.
+//
+// Returns the number of removed entries.
+func (m *MemoryCache) sweep(now time.Time) int {
+	var n int
+	for _, s := range m.all() {
+		s.mu.Lock()
+		for s.expiry.Len() > 0 && s.expiry[0].Due.Before(now) {
+			s.remove(s.expiry[0])
+			n++
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Lookup implements CacheBackend.
+// The IPs field of the answered entry is left empty.
+func (m *MemoryCache) Lookup(ip netip.Addr) (CacheEntry, bool, error) {
+	for _, s := range []*memShard{m.bucketShard(ip), m.wide} {
+		if entry, ok := s.lookup(ip); ok {
+			return entry, true, nil
+		}
+	}
+	return CacheEntry{}, false, nil
+}
+
+// lookup retrieves the entry of the longest prefix of s containing ip,
+// and marks it as most recently used.
+func (s *memShard) lookup(ip netip.Addr) (CacheEntry, bool) {
+	// Write lock, as the LRU list is updated
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.prefixes.match(ip)
+	if !ok {
+		return CacheEntry{}, false
+	}
+	entry := value.(*memEntry)
+	entry.Hits++
+	s.lru.MoveToFront(entry.elem)
+	return entry.CacheEntry, true
+}
+
+// Store implements CacheBackend.
+func (m *MemoryCache) Store(ip netip.Addr, data CacheEntry) error {
+	key := ip.String()
+	entry := &memEntry{
+		CacheEntry: data,
+		ips:        map[string]interface{}{key: nil},
+	}
+	entry.IPs = nil
+	ones, _ := entry.Prefix.Mask.Size()
+	// Lock the shards involved, bucket shard first.
+	bucket := m.bucketShard(ip)
+	target := m.prefixShard(entry.Prefix)
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	wideLocked := false
+	if target == m.wide {
+		m.wide.mu.Lock()
+		defer m.wide.mu.Unlock()
+		wideLocked = true
+	}
+	// Replace the entry of the same prefix,
+	// keeping its IP addresses and hits if of the same ASN.
+	if value, ok := target.prefixes.get(entry.Prefix); ok {
+		old := value.(*memEntry)
+		if !old.Negative && !entry.Negative && old.Info.Asn == entry.Info.Asn {
+			for oldIP := range old.ips {
+				entry.ips[oldIP] = nil
+			}
+			entry.Hits = old.Hits
+		}
+		target.remove(old)
+	}
+	// Forget ip in the entry answering it so far:
+	// remove it if more specific, as it would shadow the new one.
+	// It is in the bucket shard, or else in the wide one.
+	owner := bucket
+	value, ok := bucket.prefixes.match(ip)
+	if !ok {
+		if !wideLocked {
+			m.wide.mu.Lock()
+			defer m.wide.mu.Unlock()
+		}
+		owner = m.wide
+		value, ok = m.wide.prefixes.match(ip)
+	}
+	if ok {
+		old := value.(*memEntry)
+		if oldOnes, _ := old.Prefix.Mask.Size(); oldOnes > ones {
+			owner.remove(old)
+		} else {
+			delete(old.ips, key)
+		}
+	}
+	target.add(entry)
+	return nil
+}
+
+// add inserts an entry in the prefix table, the ASN map,
+// the LRU list (as most recently used) and the expiry heap,
+// then evicts entries beyond the maximum number.
+// Caller must hold the write lock,
+// and make sure no entry of the same prefix is cached.
+func (s *memShard) add(entry *memEntry) {
+	// Update prefix table
+	s.prefixes.insert(entry.Prefix, entry)
+	// Update ASN map
+	if !entry.Negative {
+		asn := entry.Info.Asn
+		if s.asn[asn] == nil {
+			s.asn[asn] = make(map[string]*memEntry)
+		}
+		s.asn[asn][entry.Prefix.String()] = entry
+	}
+	// Update LRU list and expiry heap
+	entry.elem = s.lru.PushFront(entry)
+	heap.Push(&s.expiry, entry)
+	// Evict least recently used entries
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back().Value.(*memEntry))
+		s.evictions++
+	}
+}
+
+// remove deletes an entry from the prefix table, the ASN map,
+// the LRU list and the expiry heap.
+// Caller must hold the write lock.
+func (s *memShard) remove(entry *memEntry) {
+	s.prefixes.remove(entry.Prefix)
+	if !entry.Negative {
+		asn := entry.Info.Asn
+		delete(s.asn[asn], entry.Prefix.String())
+		if len(s.asn[asn]) < 1 {
+			delete(s.asn, asn)
+		}
+	}
+	s.lru.Remove(entry.elem)
+	heap.Remove(&s.expiry, entry.index)
+}
+
+// AsnIPs implements CacheBackend.
+func (m *MemoryCache) AsnIPs(asn string) ([]string, error) {
+	answer := []string{}
+	for _, s := range m.all() {
+		s.mu.RLock()
+		for _, entry := range s.asn[asn] {
+			for ip := range entry.ips {
+				answer = append(answer, ip)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return answer, nil
+}
+
+// Asns implements CacheBackend.
+func (m *MemoryCache) Asns() ([]string, error) {
+	asns := make(map[string]interface{})
+	for _, s := range m.all() {
+		s.mu.RLock()
+		for asn := range s.asn {
+			asns[asn] = nil
+		}
+		s.mu.RUnlock()
+	}
+	answer := make([]string, 0, len(asns))
+	for asn := range asns {
+		answer = append(answer, asn)
+	}
+	return answer, nil
+}
+
+// PurgeAsn implements CacheBackend.
+func (m *MemoryCache) PurgeAsn(asn string) error {
+	for _, s := range m.all() {
+		s.mu.Lock()
+		for _, entry := range s.asn[asn] {
+			s.remove(entry)
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// PurgeAll implements CacheBackend.
+func (m *MemoryCache) PurgeAll() error {
+	for _, s := range m.all() {
+		s.mu.Lock()
+		s.prefixes.clear()
+		for asn := range s.asn {
+			delete(s.asn, asn)
+		}
+		s.lru.Init()
+		s.expiry = nil
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Close implements CacheBackend. It stops the background sweeping.
+// It is safe to call Close more than once.
+func (m *MemoryCache) Close() error {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+	return nil
+}
+
+// entries returns a copy of the cache entries, with their IP addresses,
+// shard by shard from least to most recently used.
+func (m *MemoryCache) entries() []CacheEntry {
+	var entries []CacheEntry
+	for _, s := range m.all() {
+		s.mu.RLock()
+		for e := s.lru.Back(); e != nil; e = e.Prev() {
+			entry := e.Value.(*memEntry)
+			copied := entry.CacheEntry
+			copied.IPs = make([]string, 0, len(entry.ips))
+			for ip := range entry.ips {
+				copied.IPs = append(copied.IPs, ip)
+			}
+			entries = append(entries, copied)
+		}
+		s.mu.RUnlock()
+	}
+	return entries
+}
+
+// Len returns the number of cache entries.
+func (m *MemoryCache) Len() int {
+	var n int
+	for _, s := range m.all() {
+		s.mu.RLock()
+		n += s.lru.Len()
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Evictions returns the number of entries evicted so far
+// to keep the cache within its maximum size.
+func (m *MemoryCache) Evictions() uint64 {
+	var n uint64
+	for _, s := range m.all() {
+		s.mu.RLock()
+		n += s.evictions
+		s.mu.RUnlock()
+	}
+	return n
+}
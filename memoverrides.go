@@ -0,0 +1,119 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryOverrides is an OverridesStore keeping overrides in memory,
+// for the lifetime of the process.
+type MemoryOverrides struct {
+	// Concurrent access control to names
+	mu sync.RWMutex
+	// Description overrides, by ASN
+	names map[string]string
+}
+
+// NewMemoryOverrides returns a MemoryOverrides
+// holding a given list of overrides.
+func NewMemoryOverrides(overrides ...AsnOverride) *MemoryOverrides {
+	m := &MemoryOverrides{names: make(map[string]string)}
+	for _, override := range overrides {
+		m.names[override.Asn] = override.Name
+	}
+	return m
+}
+
+// Lookup implements OverridesStore.
+func (m *MemoryOverrides) Lookup(ctx context.Context, asn string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	name, ok := m.names[asn]
+	if !ok {
+		return "", OverridesAsnNotFoundError
+	}
+	return name, nil
+}
+
+// Set implements OverridesStore.
+func (m *MemoryOverrides) Set(ctx context.Context, asn string, descr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names[asn] = descr
+	return nil
+}
+
+// Remove implements OverridesStore.
+func (m *MemoryOverrides) Remove(ctx context.Context, asn string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.names, asn)
+	return nil
+}
+
+// List implements OverridesStore.
+// Overrides are sorted by ASN.
+func (m *MemoryOverrides) List(ctx context.Context) ([]AsnOverride, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return sortedOverrides(m.names), nil
+}
+
+// Apply sets and removes several overrides at once,
+// atomically (see OverridesImport).
+func (m *MemoryOverrides) Apply(ctx context.Context, set []AsnOverride, remove []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	applyOverrides(m.names, set, remove)
+	return nil
+}
+
+// applyOverrides sets and removes overrides
+// in a map of description overrides by ASN.
+func applyOverrides(names map[string]string, set []AsnOverride, remove []string) {
+	for _, asn := range remove {
+		delete(names, asn)
+	}
+	for _, override := range set {
+		names[override.Asn] = override.Name
+	}
+}
+
+// sortedOverrides converts a map of description overrides by ASN
+// to a list sorted by ASN.
+func sortedOverrides(names map[string]string) []AsnOverride {
+	answer := make([]AsnOverride, 0, len(names))
+	for asn, name := range names {
+		answer = append(answer, AsnOverride{Asn: asn, Name: name})
+	}
+	sort.Slice(answer, func(i, j int) bool {
+		return answer[i].Asn < answer[j].Asn
+	})
+	return answer
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sourceDurationBuckets are the upper bounds, in seconds,
+// of the buckets of the latency histograms of sources.
+var sourceDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Results of source queries, as counted by metrics.
+const (
+	sourceSuccess = "success"
+	sourceUnknown = "unknown"
+	sourceFailure = "failure"
+)
+
+// metrics counts what a Handler does (see MetricsHandler).
+// Its methods are safe for concurrent use,
+// and do nothing on a nil *metrics.
+type metrics struct {
+	cacheHits      uint64
+	cacheMisses    uint64
+	cacheStaleHits uint64
+	overrides      uint64
+	overrideHits   uint64
+	// Concurrent access control to sources
+	mu sync.RWMutex
+	// Source metrics, by source name
+	sources map[string]*sourceMetrics
+}
+
+// sourceMetrics counts the queries of a source.
+type sourceMetrics struct {
+	// Number of queries, by result
+	success uint64
+	unknown uint64
+	failure uint64
+	// Number of queries, by latency bucket, then beyond the last one
+	buckets []uint64
+	// Total latency, in nanoseconds
+	nanos uint64
+}
+
+// newMetrics returns metrics with all counters at zero.
+func newMetrics() *metrics {
+	return &metrics{sources: make(map[string]*sourceMetrics)}
+}
+
+// cacheLookup counts the outcome of a cache lookup (see cache.lookupByIP).
+func (m *metrics) cacheLookup(info AsnInfo, expired bool, found bool) {
+	if m == nil {
+		return
+	}
+	switch {
+	case found && !expired:
+		atomic.AddUint64(&m.cacheHits, 1)
+	case found && info.Cache == CacheStale:
+		atomic.AddUint64(&m.cacheStaleHits, 1)
+	default:
+		atomic.AddUint64(&m.cacheMisses, 1)
+	}
+}
+
+// override counts an overrides lookup, and if it found a description.
+func (m *metrics) override(found bool) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.overrides, 1)
+	if found {
+		atomic.AddUint64(&m.overrideHits, 1)
+	}
+}
+
+// sourceQuery counts a query to a given source,
+// started at a given date, with a given result.
+func (m *metrics) sourceQuery(name string, start time.Time, result string) {
+	if m == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	m.mu.RLock()
+	s, ok := m.sources[name]
+	m.mu.RUnlock()
+	if !ok {
+		m.mu.Lock()
+		if s, ok = m.sources[name]; !ok {
+			s = &sourceMetrics{buckets: make([]uint64, len(sourceDurationBuckets)+1)}
+			m.sources[name] = s
+		}
+		m.mu.Unlock()
+	}
+	switch result {
+	case sourceSuccess:
+		atomic.AddUint64(&s.success, 1)
+	case sourceUnknown:
+		atomic.AddUint64(&s.unknown, 1)
+	default:
+		atomic.AddUint64(&s.failure, 1)
+	}
+	i := sort.SearchFloat64s(sourceDurationBuckets, elapsed.Seconds())
+	atomic.AddUint64(&s.buckets[i], 1)
+	atomic.AddUint64(&s.nanos, uint64(elapsed))
+}
+
+// MetricsHandler returns an http.Handler exposing the metrics of h
+// in the Prometheus text format, for scraping:
+//
+//	http.Handle("/metrics", h.MetricsHandler())
+//
+// Exposed metrics are:
+//
+//	geoipdb_cache_hits_total          LookupAsn answers found in cache
+//	geoipdb_cache_stale_hits_total    answers found expired in cache (see CacheConfig.MaxStale)
+//	geoipdb_cache_misses_total        answers not found in cache
+//	geoipdb_cache_evictions_total     entries evicted by the cache size limit
+//	geoipdb_cache_entries             cached prefixes
+//	geoipdb_overrides_lookups_total   lookups of ASN description overrides
+//	geoipdb_overrides_hits_total      overrides found
+//	geoipdb_source_queries_total      source queries, by source and result
+//	geoipdb_source_duration_seconds   histogram of source latencies, by source
+//
+// Source results are "success", "unknown" (no ASN found)
+// and "failure".
+// Cache size and evictions are exposed for backends
+// having Len and Evictions methods (as MemoryCache has).
+func (h Handler) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		h.writeMetrics(w)
+	})
+}
+
+// writeMetrics writes the metrics of h in the Prometheus text format.
+func (h Handler) writeMetrics(w io.Writer) error {
+	m := h.metrics
+	if m == nil {
+		m = newMetrics()
+	}
+	bw := bufio.NewWriter(w)
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("geoipdb_cache_hits_total", "LookupAsn answers found in cache.", atomic.LoadUint64(&m.cacheHits))
+	counter("geoipdb_cache_stale_hits_total", "LookupAsn answers found expired in cache.", atomic.LoadUint64(&m.cacheStaleHits))
+	counter("geoipdb_cache_misses_total", "LookupAsn answers not found in cache.", atomic.LoadUint64(&m.cacheMisses))
+	if sizer, ok := h.cache.backend.(interface {
+		Len() int
+		Evictions() uint64
+	}); ok {
+		counter("geoipdb_cache_evictions_total", "Cache entries evicted by the cache size limit.", sizer.Evictions())
+		fmt.Fprintf(bw, "# HELP geoipdb_cache_entries Cached prefixes.\n# TYPE geoipdb_cache_entries gauge\ngeoipdb_cache_entries %d\n", sizer.Len())
+	}
+	counter("geoipdb_overrides_lookups_total", "Lookups of ASN description overrides.", atomic.LoadUint64(&m.overrides))
+	counter("geoipdb_overrides_hits_total", "ASN description overrides found.", atomic.LoadUint64(&m.overrideHits))
+	// Sources, by name
+	m.mu.RLock()
+	names := make([]string, 0, len(m.sources))
+	for name := range m.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sources := make([]*sourceMetrics, len(names))
+	for i, name := range names {
+		sources[i] = m.sources[name]
+	}
+	m.mu.RUnlock()
+	fmt.Fprintf(bw, "# HELP geoipdb_source_queries_total ASN source queries, by result.\n# TYPE geoipdb_source_queries_total counter\n")
+	for i, s := range sources {
+		label := escapeLabel(names[i])
+		fmt.Fprintf(bw, "geoipdb_source_queries_total{source=\"%s\",result=\"%s\"} %d\n", label, sourceSuccess, atomic.LoadUint64(&s.success))
+		fmt.Fprintf(bw, "geoipdb_source_queries_total{source=\"%s\",result=\"%s\"} %d\n", label, sourceUnknown, atomic.LoadUint64(&s.unknown))
+		fmt.Fprintf(bw, "geoipdb_source_queries_total{source=\"%s\",result=\"%s\"} %d\n", label, sourceFailure, atomic.LoadUint64(&s.failure))
+	}
+	fmt.Fprintf(bw, "# HELP geoipdb_source_duration_seconds ASN source query latencies.\n# TYPE geoipdb_source_duration_seconds histogram\n")
+	for i, s := range sources {
+		label := escapeLabel(names[i])
+		var count uint64
+		for j, le := range sourceDurationBuckets {
+			count += atomic.LoadUint64(&s.buckets[j])
+			fmt.Fprintf(bw, "geoipdb_source_duration_seconds_bucket{source=\"%s\",le=\"%g\"} %d\n", label, le, count)
+		}
+		count += atomic.LoadUint64(&s.buckets[len(sourceDurationBuckets)])
+		fmt.Fprintf(bw, "geoipdb_source_duration_seconds_bucket{source=\"%s\",le=\"+Inf\"} %d\n", label, count)
+		fmt.Fprintf(bw, "geoipdb_source_duration_seconds_sum{source=\"%s\"} %g\n", label, time.Duration(atomic.LoadUint64(&s.nanos)).Seconds())
+		fmt.Fprintf(bw, "geoipdb_source_duration_seconds_count{source=\"%s\"} %d\n", label, count)
+	}
+	return bw.Flush()
+}
+
+// labelEscaper escapes Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel returns a label value escaped for the Prometheus text format.
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
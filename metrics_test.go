@@ -0,0 +1,67 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	failing := &fakeSource{name: "failing", err: errors.New("boom")}
+	src := &fakeSource{name: "fake", asn: "AS13335", descr: "CLOUDFLARENET", prefix: "1.0.0.0/24"}
+	h := newSourcesHandler(t, failing, src)
+	for _, ip := range []string{"1.0.0.1", "1.0.0.2", "1.0.0.3"} {
+		if _, _, err := h.LookupAsn(ip); err != nil {
+			t.Fatalf("LookupAsn failed: %s", err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+	body, _ := ioutil.ReadAll(rec.Body)
+	for _, line := range []string{
+		"# TYPE geoipdb_cache_hits_total counter",
+		"geoipdb_cache_hits_total 2",
+		"geoipdb_cache_misses_total 1",
+		"geoipdb_cache_stale_hits_total 0",
+		"geoipdb_cache_entries 1",
+		"geoipdb_cache_evictions_total 0",
+		`geoipdb_source_queries_total{source="failing",result="failure"} 1`,
+		`geoipdb_source_queries_total{source="fake",result="success"} 1`,
+		`geoipdb_source_duration_seconds_bucket{source="fake",le="+Inf"} 1`,
+		`geoipdb_source_duration_seconds_count{source="failing"} 1`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatalf("metric %q not found in:\n%s", line, body)
+		}
+	}
+}
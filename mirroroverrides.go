@@ -0,0 +1,251 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultOverridesMirrorInterval is the default period
+// of the refreshes of an OverridesMirror.
+const DefaultOverridesMirrorInterval = time.Minute
+
+// overridesMirrorFullRefresh is the number of refresh periods
+// after which an OverridesMirror reloads overrides,
+// even though the store version did not change,
+// in case overrides were changed without updating it.
+const overridesMirrorFullRefresh = 10
+
+// overridesVersioner is an OverridesStore telling cheaply
+// if its overrides changed (see OverridesMirror).
+type overridesVersioner interface {
+	// Version answers a string changing when overrides change,
+	// or an empty string if unknown.
+	Version(ctx context.Context) (string, error)
+}
+
+// OverridesMirror is an OverridesStore keeping an in-memory copy
+// of the overrides of another store, so that lookups never wait for it.
+//
+// The copy is refreshed in the background every interval,
+// only when the version of the store changed
+// if it has a Version method (as MongoOverrides and FileOverrides have),
+// and at least every 10 intervals anyway.
+// Changes made through the mirror are written to the store,
+// then applied to the copy right away.
+// Until the first refresh succeeds, the store is queried directly.
+type OverridesMirror struct {
+	store    OverridesStore
+	interval time.Duration
+	// Serializes refreshes
+	refreshMu sync.Mutex
+	// Concurrent access control to the fields below
+	mu sync.RWMutex
+	// Copy of the overrides, by ASN
+	names map[string]string
+	// Version of the copy, if the store has one
+	version string
+	// If the copy was loaded, and when
+	loaded bool
+	listed time.Time
+	// Number of changes made through the mirror
+	changes uint64
+	// Closed to stop refreshes
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewOverridesMirror returns an OverridesMirror of a given store,
+// refreshed every interval until closed.
+// Zero means DefaultOverridesMirrorInterval.
+//
+// The first refresh is started right away, in the background.
+func NewOverridesMirror(store OverridesStore, interval time.Duration) *OverridesMirror {
+	if interval <= 0 {
+		interval = DefaultOverridesMirrorInterval
+	}
+	m := &OverridesMirror{
+		store:    store,
+		interval: interval,
+		names:    make(map[string]string),
+		stop:     make(chan struct{}),
+	}
+	go m.poll()
+	return m
+}
+
+// WithOverridesMirror makes the Handler look overrides up
+// in an OverridesMirror of its overrides store,
+// refreshed every interval (see NewOverridesMirror),
+// so that uncached LookupAsn calls do not query the store.
+// The mirror is closed by Handler.Close.
+func WithOverridesMirror(interval time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.mirrorInterval = interval
+		if h.mirrorInterval <= 0 {
+			h.mirrorInterval = DefaultOverridesMirrorInterval
+		}
+	}
+}
+
+// poll refreshes the copy every interval until m is closed.
+func (m *OverridesMirror) poll() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.Refresh()
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Refresh reloads the copy of the overrides from the store,
+// unless the store version is known and did not change since last loaded,
+// less than 10 intervals ago.
+//
+// Returns an error if the store cannot be queried,
+// in which case the copy is kept.
+func (m *OverridesMirror) Refresh() error {
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	defer cancel()
+	m.mu.RLock()
+	changes := m.changes
+	m.mu.RUnlock()
+	var version string
+	if versioner, ok := m.store.(overridesVersioner); ok {
+		v, err := versioner.Version(ctx)
+		if err != nil {
+			return err
+		}
+		m.mu.RLock()
+		unchanged := m.loaded && v != "" && v == m.version &&
+			time.Since(m.listed) < overridesMirrorFullRefresh*m.interval
+		m.mu.RUnlock()
+		if unchanged {
+			return nil
+		}
+		version = v
+	}
+	listed := time.Now()
+	overrides, err := m.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string, len(overrides))
+	for _, override := range overrides {
+		names[override.Asn] = override.Name
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.changes != changes {
+		// Overrides may predate changes made meanwhile,
+		// reloaded on next refresh.
+		return nil
+	}
+	m.names, m.version, m.loaded, m.listed = names, version, true, listed
+	return nil
+}
+
+// Close stops the refreshes of the copy.
+// The store is left open, as owned by the caller.
+// It is safe to call Close more than once.
+func (m *OverridesMirror) Close() error {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+	return nil
+}
+
+// Lookup implements OverridesStore.
+func (m *OverridesMirror) Lookup(ctx context.Context, asn string) (string, error) {
+	m.mu.RLock()
+	name, ok := m.names[asn]
+	loaded := m.loaded
+	m.mu.RUnlock()
+	if !loaded {
+		return m.store.Lookup(ctx, asn)
+	}
+	if !ok {
+		return "", OverridesAsnNotFoundError
+	}
+	return name, nil
+}
+
+// Set implements OverridesStore.
+func (m *OverridesMirror) Set(ctx context.Context, asn string, descr string) error {
+	if err := m.store.Set(ctx, asn, descr); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.names[asn] = descr
+	m.changes++
+	m.mu.Unlock()
+	return nil
+}
+
+// Remove implements OverridesStore.
+func (m *OverridesMirror) Remove(ctx context.Context, asn string) error {
+	if err := m.store.Remove(ctx, asn); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.names, asn)
+	m.changes++
+	m.mu.Unlock()
+	return nil
+}
+
+// Apply sets and removes several overrides at once,
+// atomically if the store supports it (see OverridesImport).
+func (m *OverridesMirror) Apply(ctx context.Context, set []AsnOverride, remove []string) error {
+	if err := applyToStore(ctx, m.store, set, remove); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	applyOverrides(m.names, set, remove)
+	m.changes++
+	m.mu.Unlock()
+	return nil
+}
+
+// List implements OverridesStore.
+// Overrides are sorted by ASN.
+func (m *OverridesMirror) List(ctx context.Context) ([]AsnOverride, error) {
+	m.mu.RLock()
+	if !m.loaded {
+		m.mu.RUnlock()
+		return m.store.List(ctx)
+	}
+	defer m.mu.RUnlock()
+	return sortedOverrides(m.names), nil
+}
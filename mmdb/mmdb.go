@@ -0,0 +1,509 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+/*
+Package mmdb is a pure Go reader of MaxMind DB files,
+such as GeoLite2-ASN.mmdb or DB-IP ASN Lite databases.
+
+See https://maxmind.github.io/MaxMind-DB/ for the format specification.
+*/
+package mmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// metadataMarker precedes the metadata section of a database.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// metadataMaxSize is the maximum size of the metadata section.
+const metadataMaxSize = 128 * 1024
+
+// dataSectionSeparatorSize is the size of the gap
+// between the search tree and the data section.
+const dataSectionSeparatorSize = 16
+
+// maxDecodeDepth limits nesting of maps and arrays in the data section.
+const maxDecodeDepth = 32
+
+var (
+	// InvalidDatabaseError is returned on parse failure of a database.
+	InvalidDatabaseError = errors.New("invalid MaxMind DB")
+	// IPv6LookupError is returned on lookup of an IPv6 address
+	// in an IPv4-only database.
+	IPv6LookupError = errors.New("IPv6 address lookup in an IPv4 database")
+)
+
+// Metadata describes a database.
+type Metadata struct {
+	NodeCount                uint
+	RecordSize               uint
+	IPVersion                uint
+	DatabaseType             string
+	Languages                []string
+	BinaryFormatMajorVersion uint
+	BinaryFormatMinorVersion uint
+	BuildEpoch               uint64
+	Description              map[string]string
+}
+
+// Reader answers queries to a MaxMind DB.
+// It is safe for concurrent use.
+type Reader struct {
+	// Metadata of the database.
+	Metadata Metadata
+	// Search tree section
+	tree []byte
+	// Data section decoder
+	data decoder
+	// Search tree node of the ::/96 network,
+	// and its depth, for lookup of IPv4 addresses in IPv6 databases.
+	ipv4Start      uint
+	ipv4StartDepth int
+}
+
+// Open reads a database from a file.
+func Open(path string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes parses a database from its content.
+// Parameter buf must not be modified afterwards.
+func FromBytes(buf []byte) (*Reader, error) {
+	searchFrom := 0
+	if len(buf) > metadataMaxSize {
+		searchFrom = len(buf) - metadataMaxSize
+	}
+	i := bytes.LastIndex(buf[searchFrom:], metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: metadata not found", InvalidDatabaseError)
+	}
+	metaStart := searchFrom + i + len(metadataMarker)
+	meta, err := decodeMetadata(decoder{buf[metaStart:]})
+	if err != nil {
+		return nil, err
+	}
+	switch meta.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", InvalidDatabaseError, meta.RecordSize)
+	}
+	if meta.IPVersion != 4 && meta.IPVersion != 6 {
+		return nil, fmt.Errorf("%s: unsupported ip version %d", InvalidDatabaseError, meta.IPVersion)
+	}
+	treeSize := meta.NodeCount * meta.RecordSize / 4
+	dataStart := treeSize + dataSectionSeparatorSize
+	if dataStart > uint(searchFrom+i) {
+		return nil, fmt.Errorf("%s: search tree exceeds database size", InvalidDatabaseError)
+	}
+	r := &Reader{
+		Metadata: meta,
+		tree:     buf[:treeSize],
+		data:     decoder{buf[dataStart : searchFrom+i]},
+	}
+	if meta.IPVersion == 6 {
+		node := uint(0)
+		depth := 0
+		for ; depth < 96 && node < meta.NodeCount; depth++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start, r.ipv4StartDepth = node, depth
+	}
+	return r, nil
+}
+
+// decodeMetadata parses the metadata section of a database.
+func decodeMetadata(d decoder) (Metadata, error) {
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return Metadata{}, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return Metadata{}, fmt.Errorf("%s: metadata is not a map", InvalidDatabaseError)
+	}
+	var meta Metadata
+	meta.NodeCount = uint(asUint(m["node_count"]))
+	meta.RecordSize = uint(asUint(m["record_size"]))
+	meta.IPVersion = uint(asUint(m["ip_version"]))
+	meta.DatabaseType, _ = m["database_type"].(string)
+	meta.BinaryFormatMajorVersion = uint(asUint(m["binary_format_major_version"]))
+	meta.BinaryFormatMinorVersion = uint(asUint(m["binary_format_minor_version"]))
+	meta.BuildEpoch = asUint(m["build_epoch"])
+	if languages, ok := m["languages"].([]interface{}); ok {
+		for _, l := range languages {
+			if s, ok := l.(string); ok {
+				meta.Languages = append(meta.Languages, s)
+			}
+		}
+	}
+	meta.Description = make(map[string]string)
+	if description, ok := m["description"].(map[string]interface{}); ok {
+		for k, v := range description {
+			if s, ok := v.(string); ok {
+				meta.Description[k] = s
+			}
+		}
+	}
+	if meta.BinaryFormatMajorVersion != 2 {
+		return Metadata{}, fmt.Errorf("%s: unsupported format version %d", InvalidDatabaseError, meta.BinaryFormatMajorVersion)
+	}
+	return meta, nil
+}
+
+// asUint converts a decoded unsigned integer to uint64.
+// Answers zero if v is not an unsigned integer.
+func asUint(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
+
+// readRecord answers the left (bit 0) or right (bit 1) record of a node.
+func (r *Reader) readRecord(node uint, bit byte) uint {
+	switch r.Metadata.RecordSize {
+	case 24:
+		b := r.tree[node*6+uint(bit)*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b := r.tree[node*8+uint(bit)*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+// Lookup searches the database for a given ip address.
+//
+// Returns
+// the decoded data record (nil if ip is not in the database)
+// and the network of the search tree that contains ip.
+//
+// Data records are decoded as follows:
+// maps as map[string]interface{},
+// arrays as []interface{},
+// unsigned integers as uint64 (uint128 as *big.Int),
+// signed integers as int64,
+// and other types as their natural Go counterpart.
+func (r *Reader) Lookup(ip net.IP) (interface{}, *net.IPNet, error) {
+	var addr net.IP
+	var node uint
+	var depth, skip int
+	if ip4 := ip.To4(); ip4 != nil {
+		addr = ip4
+		if r.Metadata.IPVersion == 6 {
+			node, depth, skip = r.ipv4Start, r.ipv4StartDepth, 96
+		}
+	} else if ip16 := ip.To16(); ip16 != nil {
+		if r.Metadata.IPVersion == 4 {
+			return nil, nil, IPv6LookupError
+		}
+		addr = ip16
+	} else {
+		return nil, nil, fmt.Errorf("malformed IP address")
+	}
+	bitCount := len(addr)*8 + skip
+	for ; depth < bitCount && node < r.Metadata.NodeCount; depth++ {
+		i := depth - skip
+		node = r.readRecord(node, (addr[i>>3]>>(7-uint(i&7)))&1)
+	}
+	prefixLen := depth - skip
+	if prefixLen < 0 {
+		prefixLen = 0
+	}
+	mask := net.CIDRMask(prefixLen, len(addr)*8)
+	network := &net.IPNet{IP: addr.Mask(mask), Mask: mask}
+	if node == r.Metadata.NodeCount {
+		return nil, network, nil
+	}
+	if node < r.Metadata.NodeCount {
+		return nil, nil, fmt.Errorf("%s: search tree is deeper than address size", InvalidDatabaseError)
+	}
+	offset := node - r.Metadata.NodeCount - dataSectionSeparatorSize
+	record, _, err := r.data.decode(offset, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, network, nil
+}
+
+// Data section field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decoder decodes fields of a data section.
+type decoder struct {
+	buf []byte
+}
+
+// corrupt answers an error about malformed data at a given offset.
+func (d decoder) corrupt(offset uint) error {
+	return fmt.Errorf("%s: corrupt data at offset %d", InvalidDatabaseError, offset)
+}
+
+// bytesAt answers n bytes at a given offset.
+func (d decoder) bytesAt(offset uint, n uint) ([]byte, error) {
+	if offset+n < offset || offset+n > uint(len(d.buf)) {
+		return nil, d.corrupt(offset)
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// sizeHint answers the number of elements to preallocate
+// for a map or array of a given size at a given offset:
+// no more than the bytes left after offset can hold,
+// each element taking at least minBytes.
+func (d decoder) sizeHint(offset uint, size uint, minBytes uint) int {
+	var left uint
+	if offset < uint(len(d.buf)) {
+		left = (uint(len(d.buf)) - offset) / minBytes
+	}
+	if size > left {
+		return int(left)
+	}
+	return int(size)
+}
+
+// uintAt decodes an n bytes big endian unsigned integer at a given offset.
+func (d decoder) uintAt(offset uint, n uint) (uint64, error) {
+	b, err := d.bytesAt(offset, n)
+	if err != nil {
+		return 0, err
+	}
+	var answer uint64
+	for _, x := range b {
+		answer = answer<<8 | uint64(x)
+	}
+	return answer, nil
+}
+
+// control decodes the control bytes of a field.
+//
+// Returns
+// the field type,
+// its size (for pointers, the 5 payload bits of the control byte)
+// and the offset of the field payload.
+func (d decoder) control(offset uint) (int, uint, uint, error) {
+	b, err := d.bytesAt(offset, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	offset++
+	typ := int(b[0] >> 5)
+	size := uint(b[0] & 0x1F)
+	if typ == typePointer {
+		return typ, size, offset, nil
+	}
+	if typ == typeExtended {
+		ext, err := d.bytesAt(offset, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		offset++
+		typ = 7 + int(ext[0])
+		if typ <= typeMap || typ > typeFloat {
+			return 0, 0, 0, d.corrupt(offset)
+		}
+	}
+	if size >= 29 {
+		n := size - 28
+		extra, err := d.uintAt(offset, n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(extra)
+		case 2:
+			size = 285 + uint(extra)
+		default:
+			size = 65821 + uint(extra)
+		}
+	}
+	return typ, size, offset, nil
+}
+
+// decode decodes the field at a given offset.
+//
+// Returns
+// the decoded value
+// and the offset of the next field.
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, d.corrupt(offset)
+	}
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if targetType, _, _, err := d.control(target); err != nil || targetType == typePointer {
+			return nil, 0, d.corrupt(target)
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	}
+	switch typ {
+	case typeString:
+		b, err := d.bytesAt(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return string(b), offset + size, nil
+	case typeBytes:
+		b, err := d.bytesAt(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return append([]byte{}, b...), offset + size, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, d.corrupt(offset)
+		}
+		n, err := d.uintAt(offset, size)
+		return math.Float64frombits(n), offset + size, err
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, d.corrupt(offset)
+		}
+		n, err := d.uintAt(offset, size)
+		return math.Float32frombits(uint32(n)), offset + size, err
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, d.corrupt(offset)
+		}
+		n, err := d.uintAt(offset, size)
+		return n, offset + size, err
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, d.corrupt(offset)
+		}
+		n, err := d.uintAt(offset, size)
+		shift := 32 - 8*size
+		return int64(int32(uint32(n)<<shift) >> shift), offset + size, err
+	case typeUint128:
+		b, err := d.bytesAt(offset, size)
+		if err != nil || size > 16 {
+			return nil, 0, d.corrupt(offset)
+		}
+		return new(big.Int).SetBytes(b), offset + size, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, d.corrupt(offset)
+		}
+		return size == 1, offset, nil
+	case typeMap:
+		m := make(map[string]interface{}, d.sizeHint(offset, size, 2))
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, d.corrupt(offset)
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, d.sizeHint(offset, size, 1))
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	}
+	return nil, 0, d.corrupt(offset)
+}
+
+// pointer decodes the payload of a pointer field.
+//
+// Returns
+// the offset the pointer refers to
+// and the offset of the next field.
+func (d decoder) pointer(size uint, offset uint) (uint, uint, error) {
+	n := (size>>3)&0x3 + 1
+	v := uint64(size & 0x7)
+	payload, err := d.uintAt(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	var target uint64
+	switch n {
+	case 1:
+		target = v<<8 | payload
+	case 2:
+		target = (v<<16 | payload) + 2048
+	case 3:
+		target = (v<<24 | payload) + 526336
+	default:
+		target = payload
+	}
+	return uint(target), offset + n, nil
+}
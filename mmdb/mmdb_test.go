@@ -0,0 +1,461 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mmdb
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate testdata fixtures")
+
+// fixturePath is a small GeoLite2-ASN like database,
+// also used by geoipdb tests.
+const fixturePath = "testdata/GeoLite2-ASN-Test.mmdb"
+
+// testNetwork is a network and its data, to be written to a test database.
+type testNetwork struct {
+	cidr string
+	data interface{}
+}
+
+// testPointer is encoded as a pointer to a data section offset.
+type testPointer uint
+
+// asnNetworks is the content of the fixture database.
+var asnNetworks = []testNetwork{
+	{"1.0.0.0/24", asnRecord(13335, "CLOUDFLARENET")},
+	{"8.8.4.0/24", asnRecord(15169, "GOOGLE")},
+	{"8.8.8.0/24", asnRecord(15169, "GOOGLE")},
+	{"80.10.0.0/16", asnRecord(3215, "Orange")},
+	{"2001:4860::/32", asnRecord(15169, "GOOGLE")},
+	{"2606:4700::/32", asnRecord(13335, "CLOUDFLARENET")},
+}
+
+func asnRecord(asn uint32, org string) map[string]interface{} {
+	return map[string]interface{}{
+		"autonomous_system_number":       asn,
+		"autonomous_system_organization": org,
+	}
+}
+
+// testTreeNode is a node of the search tree of a test database.
+type testTreeNode struct {
+	children [2]*testTreeNode
+	// Data section offset, if this is a leaf
+	data int
+	// Search tree node number, if this is not a leaf
+	number int
+}
+
+// testWriter encodes a test database.
+type testWriter struct {
+	data bytes.Buffer
+	// Offsets of strings already written to the data section,
+	// nil for not encoding strings as pointers
+	strings map[string]int
+}
+
+func (w *testWriter) control(buf *bytes.Buffer, typ int, size int) {
+	var ext []byte
+	if typ > typeMap {
+		ext = []byte{byte(typ - 7)}
+		typ = typeExtended
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		extra = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		size -= 285
+		extra = []byte{byte(size >> 8), byte(size)}
+		size = 30
+	default:
+		size -= 65821
+		extra = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+		size = 31
+	}
+	buf.WriteByte(byte(typ<<5 | size))
+	buf.Write(ext)
+	buf.Write(extra)
+}
+
+func minimalBytes(n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
+
+func (w *testWriter) encode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case testPointer:
+		switch {
+		case v < 2048:
+			buf.Write([]byte{byte(typePointer<<5 | v>>8), byte(v)})
+		case v < 526336:
+			v -= 2048
+			buf.Write([]byte{byte(typePointer<<5 | 1<<3 | v>>16), byte(v >> 8), byte(v)})
+		case v < 134744064:
+			v -= 526336
+			buf.Write([]byte{byte(typePointer<<5 | 2<<3 | v>>24), byte(v >> 16), byte(v >> 8), byte(v)})
+		default:
+			buf.Write([]byte{byte(typePointer<<5 | 3<<3), byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	case string:
+		if offset, ok := w.strings[v]; ok {
+			w.encode(buf, testPointer(offset))
+			return
+		}
+		if w.strings != nil && buf == &w.data {
+			// Later occurrences of this string are encoded as pointers.
+			w.strings[v] = buf.Len()
+		}
+		w.control(buf, typeString, len(v))
+		buf.WriteString(v)
+	case []byte:
+		w.control(buf, typeBytes, len(v))
+		buf.Write(v)
+	case uint16:
+		b := minimalBytes(uint64(v))
+		w.control(buf, typeUint16, len(b))
+		buf.Write(b)
+	case uint32:
+		b := minimalBytes(uint64(v))
+		w.control(buf, typeUint32, len(b))
+		buf.Write(b)
+	case uint64:
+		b := minimalBytes(v)
+		w.control(buf, typeUint64, len(b))
+		buf.Write(b)
+	case *big.Int:
+		b := v.Bytes()
+		w.control(buf, typeUint128, len(b))
+		buf.Write(b)
+	case int32:
+		b := minimalBytes(uint64(uint32(v)))
+		w.control(buf, typeInt32, len(b))
+		buf.Write(b)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		w.control(buf, typeBool, size)
+	case float64:
+		w.control(buf, typeDouble, 8)
+		buf.Write(minimalBytes8(math.Float64bits(v)))
+	case []interface{}:
+		w.control(buf, typeArray, len(v))
+		for _, x := range v {
+			w.encode(buf, x)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.control(buf, typeMap, len(v))
+		for _, k := range keys {
+			w.encode(buf, k)
+			w.encode(buf, v[k])
+		}
+	default:
+		panic("unsupported test data type")
+	}
+}
+
+// writeData appends a value to the data section.
+//
+// Returns the data section offset of the value.
+func (w *testWriter) writeData(v interface{}) int {
+	offset := w.data.Len()
+	w.encode(&w.data, v)
+	return offset
+}
+
+// writeTestDatabase builds a database holding a given list of networks.
+func writeTestDatabase(t testing.TB, ipVersion int, recordSize int, networks []testNetwork) []byte {
+	w := &testWriter{strings: make(map[string]int)}
+	root := &testTreeNode{data: -1}
+	for _, n := range networks {
+		_, inet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatalf("bad test network '%s': %s", n.cidr, err)
+		}
+		ones, _ := inet.Mask.Size()
+		addr := []byte(inet.IP)
+		if ipVersion == 6 && len(addr) == net.IPv4len {
+			addr = append(make([]byte, 12), addr...)
+			ones += 96
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (addr[i>>3] >> (7 - uint(i&7))) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &testTreeNode{data: -1}
+			}
+			node = node.children[bit]
+		}
+		node.data = w.writeData(n.data)
+	}
+	// Number internal nodes in breadth first order.
+	var nodes []*testTreeNode
+	queue := []*testTreeNode{root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		node.number = len(nodes)
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil && child.data < 0 {
+				queue = append(queue, child)
+			}
+		}
+	}
+	nodeCount := len(nodes)
+	var out bytes.Buffer
+	for _, node := range nodes {
+		var records [2]uint64
+		for bit, child := range node.children {
+			switch {
+			case child == nil:
+				records[bit] = uint64(nodeCount)
+			case child.data >= 0:
+				records[bit] = uint64(nodeCount + dataSectionSeparatorSize + child.data)
+			default:
+				records[bit] = uint64(child.number)
+			}
+		}
+		l, r := records[0], records[1]
+		switch recordSize {
+		case 24:
+			out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 28:
+			out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>20&0xF0 | r>>24&0x0F), byte(r >> 16), byte(r >> 8), byte(r)})
+		default:
+			out.Write(minimalBytes8(l)[4:])
+			out.Write(minimalBytes8(r)[4:])
+		}
+	}
+	out.Write(make([]byte, dataSectionSeparatorSize))
+	out.Write(w.data.Bytes())
+	out.Write(metadataMarker)
+	meta := &testWriter{}
+	meta.encode(&out, map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "GeoLite2-ASN",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1476576000),
+		"description":                 map[string]interface{}{"en": "geoipdb test database"},
+	})
+	return out.Bytes()
+}
+
+// minimalBytes8 answers the 8 bytes big endian encoding of n.
+func minimalBytes8(n uint64) []byte {
+	b := make([]byte, 8)
+	for i := 7; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	return b
+}
+
+func TestFixture(t *testing.T) {
+	expected := writeTestDatabase(t, 6, 28, asnNetworks)
+	if *update {
+		if err := ioutil.WriteFile(fixturePath, expected, 0644); err != nil {
+			t.Fatalf("cannot write fixture: %s", err)
+		}
+	}
+	actual, err := ioutil.ReadFile(fixturePath)
+	if err != nil {
+		t.Fatalf("cannot read fixture: %s", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("%s is outdated, regenerate it with 'go test -update'", fixturePath)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	r, err := Open(fixturePath)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	m := r.Metadata
+	if m.IPVersion != 6 || m.RecordSize != 28 || m.DatabaseType != "GeoLite2-ASN" || m.BuildEpoch != 1476576000 {
+		t.Fatalf("unexpected metadata: %+v", m)
+	}
+	if !reflect.DeepEqual(m.Languages, []string{"en"}) || m.Description["en"] != "geoipdb test database" {
+		t.Fatalf("unexpected metadata: %+v", m)
+	}
+}
+
+type lookupTestData struct {
+	ip      string
+	asn     uint64
+	org     string
+	network string
+}
+
+func TestLookup(t *testing.T) {
+	tests := []lookupTestData{
+		{"1.0.0.1", 13335, "CLOUDFLARENET", "1.0.0.0/24"},
+		{"8.8.8.8", 15169, "GOOGLE", "8.8.8.0/24"},
+		{"8.8.4.4", 15169, "GOOGLE", "8.8.4.0/24"},
+		{"80.10.246.2", 3215, "Orange", "80.10.0.0/16"},
+		{"::ffff:8.8.8.8", 15169, "GOOGLE", "8.8.8.0/24"},
+		{"2001:4860:1004::876:102", 15169, "GOOGLE", "2001:4860::/32"},
+		{"2606:4700:4700::1111", 13335, "CLOUDFLARENET", "2606:4700::/32"},
+		{"9.9.9.9", 0, "", ""},
+		{"2a00::1", 0, "", ""},
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		r, err := FromBytes(writeTestDatabase(t, 6, recordSize, asnNetworks))
+		if err != nil {
+			t.Fatalf("FromBytes failed for record size %d: %s", recordSize, err)
+		}
+		for _, test := range tests {
+			record, network, err := r.Lookup(net.ParseIP(test.ip))
+			if err != nil {
+				t.Fatalf("Lookup(%s) failed: %s", test.ip, err)
+			}
+			if test.network == "" {
+				if record != nil {
+					t.Fatalf("Lookup(%s) returned unexpected record: %v", test.ip, record)
+				}
+				continue
+			}
+			m, _ := record.(map[string]interface{})
+			if m["autonomous_system_number"] != test.asn || m["autonomous_system_organization"] != test.org {
+				t.Fatalf("Lookup(%s) returned unexpected record: %v", test.ip, record)
+			}
+			if network.String() != test.network {
+				t.Fatalf("Lookup(%s) returned unexpected network: %s", test.ip, network)
+			}
+		}
+	}
+}
+
+func TestLookupIPv4Database(t *testing.T) {
+	r, err := FromBytes(writeTestDatabase(t, 4, 24, asnNetworks[:4]))
+	if err != nil {
+		t.Fatalf("FromBytes failed: %s", err)
+	}
+	record, network, err := r.Lookup(net.ParseIP("8.8.8.8"))
+	if err != nil || record == nil || network.String() != "8.8.8.0/24" {
+		t.Fatalf("unexpected Lookup result: %v %v %v", record, network, err)
+	}
+	_, _, err = r.Lookup(net.ParseIP("2001:4860::1"))
+	if err != IPv6LookupError {
+		t.Fatalf("unexpected Lookup error: %v", err)
+	}
+}
+
+func TestDecodeTypes(t *testing.T) {
+	value := map[string]interface{}{
+		"string":  "geoipdb",
+		"long":    string(bytes.Repeat([]byte("x"), 300)),
+		"bytes":   []byte{1, 2, 3},
+		"uint16":  uint16(443),
+		"uint32":  uint32(4200000000),
+		"uint64":  uint64(1) << 60,
+		"uint128": new(big.Int).Lsh(big.NewInt(1), 100),
+		"int32":   int32(-5),
+		"bool":    true,
+		"double":  3.25,
+		"array":   []interface{}{"a", uint32(1)},
+	}
+	r, err := FromBytes(writeTestDatabase(t, 4, 24, []testNetwork{{"1.2.3.0/24", value}}))
+	if err != nil {
+		t.Fatalf("FromBytes failed: %s", err)
+	}
+	record, _, err := r.Lookup(net.ParseIP("1.2.3.4"))
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	expected := map[string]interface{}{
+		"string":  "geoipdb",
+		"long":    value["long"],
+		"bytes":   []byte{1, 2, 3},
+		"uint16":  uint64(443),
+		"uint32":  uint64(4200000000),
+		"uint64":  uint64(1) << 60,
+		"uint128": value["uint128"],
+		"int32":   int64(-5),
+		"bool":    true,
+		"double":  3.25,
+		"array":   []interface{}{"a", uint64(1)},
+	}
+	if !reflect.DeepEqual(record, expected) {
+		t.Fatalf("unexpected decoded record:\n%v\nexpected:\n%v", record, expected)
+	}
+}
+
+func TestDecodeOversized(t *testing.T) {
+	// Map and array of 16843036 elements, without data
+	for _, buf := range [][]byte{{0xff, 0xff, 0xff, 0xff}, {0x1f, 0x04, 0xff, 0xff, 0xff}} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, _, err := (decoder{buf}).decode(0, 0); err == nil {
+			t.Fatalf("decode accepted oversized data %x", buf)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+			t.Fatalf("decode of %x allocated %d bytes", buf, alloc)
+		}
+	}
+}
+
+func TestFromBytesInvalid(t *testing.T) {
+	_, err := FromBytes([]byte("not a MaxMind DB"))
+	if err == nil {
+		t.Fatalf("FromBytes accepted an invalid database")
+	}
+	db := writeTestDatabase(t, 6, 24, asnNetworks)
+	// Truncate the search tree.
+	_, err = FromBytes(db[len(db)-200:])
+	if err == nil {
+		t.Fatalf("FromBytes accepted a truncated database")
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoCache is a CacheBackend storing entries in a MongoDB collection,
+// so that Handlers of several processes share a cache:
+// an IP prefix is looked up once for all of them,
+// and purges (such as by OverridesSet) apply to all of them.
+//
+// Entries are removed by MongoDB once due, using a TTL index.
+// Hits are not counted, so that lookups do not write to the collection.
+type MongoCache struct {
+	coll    *mgo.Collection
+	timeout time.Duration
+}
+
+// mongoCacheDoc is what is stored in the cache collection.
+type mongoCacheDoc struct {
+	// Cached prefix, in CIDR notation
+	Prefix    string    `bson:"_id"`
+	Asn       string    `bson:"asn"`
+	Descr     string    `bson:"descr"`
+	RawDescr  string    `bson:"rawdescr"`
+	Overriden bool      `bson:"overriden"`
+	Source    string    `bson:"source"`
+	SrcPrefix string    `bson:"srcprefix"`
+	Country   string    `bson:"country"`
+	Registry  string    `bson:"registry"`
+	Negative  bool      `bson:"negative"`
+	IPs       []string  `bson:"ips"`
+	Expires   time.Time `bson:"expires"`
+	Due       time.Time `bson:"due"`
+	Inserted  time.Time `bson:"inserted"`
+}
+
+// NewMongoCache creates a MongoCache backed by a given collection,
+// such as one of the database of the overrides collection
+// given to NewHandler:
+//
+//	backend, err := geoipdb.NewMongoCache(overrides.Database.C("asncache"), timeout)
+//
+// Parameter timeout bounds every operation on the collection.
+// Pass zero to disable timeout.
+//
+// Returns an error if the indexes of the collection cannot be created.
+func NewMongoCache(coll *mgo.Collection, timeout time.Duration) (*MongoCache, error) {
+	m := &MongoCache{coll: coll, timeout: timeout}
+	err := m.with(func(c *mgo.Collection) error {
+		err := c.EnsureIndex(mgo.Index{Key: []string{"due"}, ExpireAfter: time.Second})
+		if err != nil {
+			return err
+		}
+		return c.EnsureIndex(mgo.Index{Key: []string{"asn"}})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot index cache collection: %s", err)
+	}
+	return m, nil
+}
+
+// with runs f against the cache collection,
+// on a copy of the collection session bounded by the timeout.
+func (m *MongoCache) with(f func(*mgo.Collection) error) error {
+	session := m.coll.Database.Session.Copy()
+	defer session.Close()
+	if m.timeout > 0 {
+		session.SetSyncTimeout(m.timeout)
+		session.SetSocketTimeout(m.timeout)
+	}
+	return f(m.coll.With(session))
+}
+
+// mongoCacheKeys returns the keys of the prefixes containing ip,
+// from the longest (host prefix) to those of a given minimum length.
+func mongoCacheKeys(ip netip.Addr, minOnes int) []string {
+	bits := ip.BitLen()
+	keys := make([]string, 0, bits+1)
+	for ones := bits; ones >= minOnes; ones-- {
+		keys = append(keys, netip.PrefixFrom(ip, ones).Masked().String())
+	}
+	return keys
+}
+
+// Lookup implements CacheBackend.
+func (m *MongoCache) Lookup(ip netip.Addr) (CacheEntry, bool, error) {
+	var docs []mongoCacheDoc
+	err := m.with(func(c *mgo.Collection) error {
+		query := bson.M{
+			"_id": bson.M{"$in": mongoCacheKeys(ip, 0)},
+			// Entries may outlive their due date
+			// until MongoDB removes them
+			"due": bson.M{"$gt": time.Now()},
+		}
+		return c.Find(query).All(&docs)
+	})
+	if err != nil {
+		return CacheEntry{}, false, err
+	}
+	var answer CacheEntry
+	var found bool
+	longest := -1
+	for _, doc := range docs {
+		entry, err := doc.entry()
+		if err != nil {
+			continue
+		}
+		if ones, _ := entry.Prefix.Mask.Size(); ones > longest {
+			answer, found, longest = entry, true, ones
+		}
+	}
+	return answer, found, nil
+}
+
+// Store implements CacheBackend.
+func (m *MongoCache) Store(ip netip.Addr, entry CacheEntry) error {
+	doc := newMongoCacheDoc(entry)
+	ones, _ := entry.Prefix.Mask.Size()
+	return m.with(func(c *mgo.Collection) error {
+		// Remove more specific entries answering ip.
+		if longer := mongoCacheKeys(ip, ones+1); len(longer) > 0 {
+			_, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": longer}})
+			if err != nil {
+				return err
+			}
+		}
+		if !entry.Negative {
+			// Update the entry of the same prefix and ASN, if any.
+			selector := bson.M{"_id": doc.Prefix, "asn": doc.Asn, "negative": false}
+			update := bson.M{
+				"$set": bson.M{
+					"descr":     doc.Descr,
+					"rawdescr":  doc.RawDescr,
+					"overriden": doc.Overriden,
+					"source":    doc.Source,
+					"srcprefix": doc.SrcPrefix,
+					"country":   doc.Country,
+					"registry":  doc.Registry,
+					"expires":   doc.Expires,
+					"due":       doc.Due,
+					"inserted":  doc.Inserted,
+				},
+				"$addToSet": bson.M{"ips": ip.String()},
+			}
+			_, err := c.Upsert(selector, update)
+			if !mgo.IsDup(err) {
+				return err
+			}
+		}
+		// Replace the entry of the same prefix.
+		doc.IPs = []string{ip.String()}
+		_, err := c.UpsertId(doc.Prefix, doc)
+		return err
+	})
+}
+
+// AsnIPs implements CacheBackend.
+func (m *MongoCache) AsnIPs(asn string) ([]string, error) {
+	var docs []mongoCacheDoc
+	err := m.with(func(c *mgo.Collection) error {
+		query := bson.M{"asn": asn, "negative": false, "due": bson.M{"$gt": time.Now()}}
+		return c.Find(query).Select(bson.M{"ips": 1}).All(&docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	answer := []string{}
+	for _, doc := range docs {
+		answer = append(answer, doc.IPs...)
+	}
+	return answer, nil
+}
+
+// Asns implements CacheBackend.
+func (m *MongoCache) Asns() ([]string, error) {
+	answer := []string{}
+	err := m.with(func(c *mgo.Collection) error {
+		query := bson.M{"negative": false, "due": bson.M{"$gt": time.Now()}}
+		return c.Find(query).Distinct("asn", &answer)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// PurgeAsn implements CacheBackend.
+func (m *MongoCache) PurgeAsn(asn string) error {
+	return m.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"asn": asn})
+		return err
+	})
+}
+
+// PurgeAll implements CacheBackend.
+func (m *MongoCache) PurgeAll() error {
+	return m.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{})
+		return err
+	})
+}
+
+// Close implements CacheBackend.
+// The collection session is left open, as owned by the caller.
+func (m *MongoCache) Close() error {
+	return nil
+}
+
+// newMongoCacheDoc converts a cache entry to its stored form.
+func newMongoCacheDoc(entry CacheEntry) mongoCacheDoc {
+	info := entry.Info
+	return mongoCacheDoc{
+		Prefix:    entry.Prefix.String(),
+		Asn:       info.Asn,
+		Descr:     info.Descr,
+		RawDescr:  info.RawDescr,
+		Overriden: info.Overriden,
+		Source:    info.Source,
+		SrcPrefix: info.Prefix,
+		Country:   info.Country,
+		Registry:  info.Registry,
+		Negative:  entry.Negative,
+		IPs:       entry.IPs,
+		Expires:   entry.Expires,
+		Due:       entry.Due,
+		Inserted:  entry.Inserted,
+	}
+}
+
+// entry converts a stored document to a cache entry.
+func (doc mongoCacheDoc) entry() (CacheEntry, error) {
+	_, prefix, err := net.ParseCIDR(doc.Prefix)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	entry := CacheEntry{
+		Prefix:   prefix,
+		Negative: doc.Negative,
+		IPs:      doc.IPs,
+		Expires:  doc.Expires,
+		Due:      doc.Due,
+		Inserted: doc.Inserted,
+	}
+	if !doc.Negative {
+		entry.Info = AsnInfo{
+			Asn:       doc.Asn,
+			Number:    asnNumber(doc.Asn),
+			Descr:     doc.Descr,
+			RawDescr:  doc.RawDescr,
+			Overriden: doc.Overriden,
+			Source:    doc.Source,
+			Prefix:    doc.SrcPrefix,
+			Country:   doc.Country,
+			Registry:  doc.Registry,
+			Expires:   doc.Expires,
+		}
+	}
+	return entry, nil
+}
@@ -26,22 +26,27 @@
 package geoipdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-// AsnOverride is what is stored in the overrides collection.
+// AsnOverride is an ASN description override, as stored by OverridesStores.
+//
+// MongoOverrides documents also have an "updated" field,
+// the date of their last change by Set (see MongoOverrides.Version).
 type AsnOverride struct {
-	Asn  string `bson:"_id" json:"asn"`
-	Name string `bson:"name" json:"name"`
+	Asn  string `bson:"_id" json:"asn" yaml:"asn"`
+	Name string `bson:"name" json:"name" yaml:"name"`
 }
 
 // OverridesNilCollectionError is returned by Overrides<...> methods
-// when Handler was created without an overrides collection
-// (see NewHandler).
+// when Handler was created without an overrides collection or store
+// (see NewHandler and WithOverrides).
 var OverridesNilCollectionError = errors.New("nil overrides collection")
 
 // OverridesAsnNotFoundError is returned by OverridesLookup
@@ -52,24 +57,192 @@ var OverridesAsnNotFoundError = errors.New("ASN not found")
 // when parameter asn does not conform to an ASN identification.
 var OverridesMalformedAsnError = errors.New("malformed ASN")
 
+// OverridesStore stores the overrides of ASN descriptions
+// (see WithOverrides).
+// Implementations must be safe for concurrent use,
+// and should give up when ctx is done.
+type OverridesStore interface {
+	// Lookup retrieves the description override of a given ASN.
+	// Returns OverridesAsnNotFoundError if there is none.
+	Lookup(ctx context.Context, asn string) (string, error)
+	// Set stores or updates the description override of a given ASN.
+	Set(ctx context.Context, asn string, descr string) error
+	// Remove deletes the description override of a given ASN, if any.
+	// Removing a missing override is not an error.
+	Remove(ctx context.Context, asn string) error
+	// List retrieves all description overrides.
+	List(ctx context.Context) ([]AsnOverride, error)
+}
+
+// WithOverrides defines the store of ASN description overrides,
+// replacing the overrides collection given to NewHandler:
+//
+//	store, err := geoipdb.NewFileOverrides("/etc/geoipdb/overrides.yaml", time.Second)
+//	...
+//	h, err := geoipdb.NewHandler(nil, timeout, geoipdb.WithOverrides(store))
+func WithOverrides(store OverridesStore) HandlerOption {
+	return func(h *Handler) {
+		h.overrides = store
+	}
+}
+
+// MongoOverrides is an OverridesStore backed by a MongoDB collection,
+// as used by NewHandler for its overrides collection.
+type MongoOverrides struct {
+	coll *mgo.Collection
+}
+
+// NewMongoOverrides returns an OverridesStore backed by a given collection.
+func NewMongoOverrides(coll *mgo.Collection) *MongoOverrides {
+	return &MongoOverrides{coll: coll}
+}
+
+// with runs f against the overrides collection,
+// giving up when ctx is done.
+//
+// Unless ctx can never be done,
+// f is run on a copy of the collection session,
+// bounded by the ctx deadline.
+//
+// Returns the error returned by f, or ctx.Err().
+func (m *MongoOverrides) with(ctx context.Context, f func(*mgo.Collection) error) error {
+	if ctx.Done() == nil {
+		return f(m.coll)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	session := m.coll.Database.Session.Copy()
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		session.SetSyncTimeout(timeout)
+		session.SetSocketTimeout(timeout)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer session.Close()
+		done <- f(m.coll.With(session))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Lookup implements OverridesStore.
+func (m *MongoOverrides) Lookup(ctx context.Context, asn string) (string, error) {
+	var override AsnOverride
+	err := m.with(ctx, func(c *mgo.Collection) error {
+		return c.FindId(asn).One(&override)
+	})
+	if err == mgo.ErrNotFound {
+		return "", OverridesAsnNotFoundError
+	}
+	if err != nil {
+		return "", err
+	}
+	return override.Name, nil
+}
+
+// Set implements OverridesStore.
+// The "updated" field of the document is set to the current date.
+func (m *MongoOverrides) Set(ctx context.Context, asn string, descr string) error {
+	return m.with(ctx, func(c *mgo.Collection) error {
+		_, err := c.UpsertId(asn, bson.M{"$set": bson.M{"name": descr, "updated": time.Now()}})
+		return err
+	})
+}
+
+// Remove implements OverridesStore.
+func (m *MongoOverrides) Remove(ctx context.Context, asn string) error {
+	err := m.with(ctx, func(c *mgo.Collection) error {
+		return c.RemoveId(asn)
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// List implements OverridesStore.
+func (m *MongoOverrides) List(ctx context.Context) ([]AsnOverride, error) {
+	// Decoded by f only, which may outlive a done ctx
+	found := make(chan []AsnOverride, 1)
+	err := m.with(ctx, func(c *mgo.Collection) error {
+		var answer []AsnOverride
+		if err := c.Find(nil).All(&answer); err != nil {
+			return err
+		}
+		found <- answer
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return <-found, nil
+}
+
+// Version answers the number of overrides
+// and the date of the most recent change made by Set,
+// so that an OverridesMirror reloads overrides only when changed.
+//
+// Returns an empty version, meaning unknown,
+// if some documents have no "updated" field,
+// e.g. when written by older versions of this package.
+func (m *MongoOverrides) Version(ctx context.Context) (string, error) {
+	var n, undated int
+	var newest struct {
+		Updated time.Time `bson:"updated"`
+	}
+	err := m.with(ctx, func(c *mgo.Collection) error {
+		var err error
+		if n, err = c.Count(); err != nil {
+			return err
+		}
+		undated, err = c.Find(bson.M{"updated": bson.M{"$exists": false}}).Count()
+		if err != nil || undated > 0 {
+			return err
+		}
+		err = c.Find(nil).Sort("-updated").Select(bson.M{"updated": 1}).One(&newest)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil || undated > 0 {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", n, newest.Updated.UnixNano()), nil
+}
+
 // OverridesLookup queries the database of local overrides
 // for the description of a given ASN.
 //
 // Returns the ASN description,
 // or OverridesAsnNotFoundError if there is no override for the ASN.
 func (h Handler) OverridesLookup(asn string) (string, error) {
+	return h.OverridesLookupContext(context.Background(), asn)
+}
+
+// OverridesLookupContext is like OverridesLookup,
+// but gives up when ctx is done.
+func (h Handler) OverridesLookupContext(ctx context.Context, asn string) (string, error) {
 	if h.overrides == nil {
 		return "", OverridesNilCollectionError
 	}
-	var override AsnOverride
-	err := h.overrides.FindId(asn).One(&override)
-	if err == mgo.ErrNotFound {
-		return "", OverridesAsnNotFoundError
+	descr, err := h.overrides.Lookup(ctx, asn)
+	if err == OverridesAsnNotFoundError {
+		return "", err
 	}
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
 		return "", fmt.Errorf("cannot lookup override: %s", err)
 	}
-	return override.Name, nil
+	return descr, nil
 }
 
 // OverridesSet stores or updates a user defined description for a given ASN
@@ -78,6 +251,12 @@ func (h Handler) OverridesLookup(asn string) (string, error) {
 // Moreover, this method purges the cache (see LookupAsn)
 // of all data related to the given asn.
 func (h Handler) OverridesSet(asn string, descr string) error {
+	return h.OverridesSetContext(context.Background(), asn, descr)
+}
+
+// OverridesSetContext is like OverridesSet,
+// but gives up when ctx is done.
+func (h Handler) OverridesSetContext(ctx context.Context, asn string, descr string) error {
 	h.cache.purgeASN(asn)
 	if h.overrides == nil {
 		return OverridesNilCollectionError
@@ -85,8 +264,10 @@ func (h Handler) OverridesSet(asn string, descr string) error {
 	if !reASN.MatchString(asn) {
 		return OverridesMalformedAsnError
 	}
-	_, err := h.overrides.UpsertId(asn, bson.M{"$set": bson.M{"name": descr}})
-	if err != nil {
+	if err := h.overrides.Set(ctx, asn, descr); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		return fmt.Errorf("cannot set override: %s", err)
 	}
 	return nil
@@ -100,15 +281,20 @@ func (h Handler) OverridesSet(asn string, descr string) error {
 // Moreover, this method purges the cache (see LookupAsn)
 // of all data related to the given asn.
 func (h Handler) OverridesRemove(asn string) error {
+	return h.OverridesRemoveContext(context.Background(), asn)
+}
+
+// OverridesRemoveContext is like OverridesRemove,
+// but gives up when ctx is done.
+func (h Handler) OverridesRemoveContext(ctx context.Context, asn string) error {
 	h.cache.purgeASN(asn)
 	if h.overrides == nil {
 		return OverridesNilCollectionError
 	}
-	err := h.overrides.RemoveId(asn)
-	if err == mgo.ErrNotFound {
-		return nil
-	}
-	if err != nil {
+	if err := h.overrides.Remove(ctx, asn); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		return fmt.Errorf("cannot remove override: %s", err)
 	}
 	return nil
@@ -116,12 +302,20 @@ func (h Handler) OverridesRemove(asn string) error {
 
 // OverridesList answers all ASN description overrides.
 func (h Handler) OverridesList() ([]AsnOverride, error) {
+	return h.OverridesListContext(context.Background())
+}
+
+// OverridesListContext is like OverridesList,
+// but gives up when ctx is done.
+func (h Handler) OverridesListContext(ctx context.Context) ([]AsnOverride, error) {
 	if h.overrides == nil {
 		return nil, OverridesNilCollectionError
 	}
-	var answer []AsnOverride
-	err := h.overrides.Find(nil).All(&answer)
+	answer, err := h.overrides.List(ctx)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		return nil, fmt.Errorf("cannot retrieve overrides: %s", err)
 	}
 	if answer == nil {
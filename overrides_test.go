@@ -0,0 +1,694 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/geoipdb"
+	bolt "go.etcd.io/bbolt"
+)
+
+// tempDir returns a temporary directory, removed at the end of the test.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "geoipdb")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestOverridesStore(t *testing.T) {
+	dir := tempDir(t)
+	var db *bolt.DB
+	stores := map[string]func() (geoipdb.OverridesStore, error){
+		"memory": func() (geoipdb.OverridesStore, error) {
+			return geoipdb.NewMemoryOverrides(), nil
+		},
+		"json": func() (geoipdb.OverridesStore, error) {
+			return geoipdb.NewFileOverrides(filepath.Join(dir, "overrides.json"), time.Hour)
+		},
+		"yaml": func() (geoipdb.OverridesStore, error) {
+			return geoipdb.NewFileOverrides(filepath.Join(dir, "overrides.yaml"), time.Hour)
+		},
+		"bolt": func() (geoipdb.OverridesStore, error) {
+			opened, err := bolt.Open(filepath.Join(dir, "overrides.db"), 0600, &bolt.Options{Timeout: time.Second})
+			if err != nil {
+				return nil, err
+			}
+			t.Cleanup(func() { opened.Close() })
+			db = opened
+			return geoipdb.NewBoltOverrides(db)
+		},
+	}
+	for name, newStore := range stores {
+		store, err := newStore()
+		if err != nil {
+			t.Fatalf("cannot create %s store: %s", name, err)
+		}
+		src := &fakeSource{name: "fake", asn: "AS13335", descr: "CLOUDFLARENET"}
+		h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(src), geoipdb.WithOverrides(store))
+		if err != nil {
+			t.Fatalf("NewHandler failed: %s", err)
+		}
+		if _, err := h.OverridesLookup("AS13335"); err != geoipdb.OverridesAsnNotFoundError {
+			t.Fatalf("unexpected %s lookup error: %v", name, err)
+		}
+		if err := h.OverridesSet("AS13335", "Cloudflare"); err != nil {
+			t.Fatalf("%s OverridesSet failed: %s", name, err)
+		}
+		if err := h.OverridesSet("AS15169", "Google"); err != nil {
+			t.Fatalf("%s OverridesSet failed: %s", name, err)
+		}
+		if err := h.OverridesSet("15169", "Google"); err != geoipdb.OverridesMalformedAsnError {
+			t.Fatalf("unexpected %s set error: %v", name, err)
+		}
+		if _, descr, _ := h.LookupAsn("1.0.0.1"); descr != "Cloudflare" {
+			t.Fatalf("%s override not applied: %s", name, descr)
+		}
+		if err := h.OverridesRemove("AS15169"); err != nil {
+			t.Fatalf("%s OverridesRemove failed: %s", name, err)
+		}
+		if err := h.OverridesRemove("AS15169"); err != nil {
+			t.Fatalf("%s OverridesRemove of missing override failed: %s", name, err)
+		}
+		list, err := h.OverridesList()
+		if err != nil || !reflect.DeepEqual(list, []geoipdb.AsnOverride{{Asn: "AS13335", Name: "Cloudflare"}}) {
+			t.Fatalf("unexpected %s list: %v %v", name, list, err)
+		}
+		h.Close()
+		// Persistent stores keep overrides.
+		if name == "bolt" {
+			db.Close()
+		}
+		if name != "memory" {
+			store, err := newStore()
+			if err != nil {
+				t.Fatalf("cannot reopen %s store: %s", name, err)
+			}
+			if descr, err := store.Lookup(context.Background(), "AS13335"); err != nil || descr != "Cloudflare" {
+				t.Fatalf("unexpected %s lookup after reopening: %s %v", name, descr, err)
+			}
+		}
+	}
+}
+
+func TestOverridesStoreNil(t *testing.T) {
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources())
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	if _, err := h.OverridesLookup("AS13335"); err != geoipdb.OverridesNilCollectionError {
+		t.Fatalf("unexpected lookup error: %v", err)
+	}
+	if _, err := h.OverridesList(); err != geoipdb.OverridesNilCollectionError {
+		t.Fatalf("unexpected list error: %v", err)
+	}
+}
+
+func TestOverridesFileReload(t *testing.T) {
+	path := filepath.Join(tempDir(t), "overrides.yml")
+	// Replaces the file at once, as refreshed in the background
+	write := func(data string, modTime time.Time) {
+		if err := ioutil.WriteFile(path+".tmp", []byte(data), 0644); err != nil {
+			t.Fatalf("cannot write overrides file: %s", err)
+		}
+		os.Chtimes(path+".tmp", modTime, modTime)
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatalf("cannot write overrides file: %s", err)
+		}
+	}
+	now := time.Now()
+	write("- asn: AS13335\n  name: Cloudflare\n", now.Add(-time.Minute))
+	store, err := geoipdb.NewFileOverrides(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileOverrides failed: %s", err)
+	}
+	ctx := context.Background()
+	if descr, err := store.Lookup(ctx, "AS13335"); err != nil || descr != "Cloudflare" {
+		t.Fatalf("unexpected lookup: %s %v", descr, err)
+	}
+	write("- asn: AS13335\n  name: Cloudflare, Inc.\n", now)
+	if descr, err := store.Lookup(ctx, "AS13335"); err != nil || descr != "Cloudflare, Inc." {
+		t.Fatalf("unexpected lookup after change: %s %v", descr, err)
+	}
+	write("- asn: [", now.Add(time.Minute))
+	if _, err := store.Lookup(ctx, "AS13335"); err == nil {
+		t.Fatalf("malformed file accepted")
+	}
+	os.Remove(path)
+	if _, err := store.Lookup(ctx, "AS13335"); err != geoipdb.OverridesAsnNotFoundError {
+		t.Fatalf("unexpected lookup error after removal: %v", err)
+	}
+	if _, err := geoipdb.NewFileOverrides(filepath.Join(filepath.Dir(path), "overrides.txt"), 0); err == nil {
+		t.Fatalf("unsupported file format accepted")
+	}
+}
+
+func TestOverridesFileMode(t *testing.T) {
+	path := filepath.Join(tempDir(t), "overrides.json")
+	store, err := geoipdb.NewFileOverrides(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileOverrides failed: %s", err)
+	}
+	ctx := context.Background()
+	expect := func(want os.FileMode) {
+		t.Helper()
+		if info, err := os.Stat(path); err != nil {
+			t.Fatalf("cannot stat overrides file: %s", err)
+		} else if info.Mode().Perm() != want {
+			t.Fatalf("unexpected file mode: %v", info.Mode())
+		}
+	}
+	// New files are readable by all, existing ones keep their mode
+	if err := store.Set(ctx, "AS13335", "Cloudflare"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	expect(0644)
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatalf("Chmod failed: %s", err)
+	}
+	if err := store.Set(ctx, "AS15169", "Google"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	expect(0640)
+}
+
+// countingOverrides is a FileOverrides counting lookups.
+type countingOverrides struct {
+	*geoipdb.FileOverrides
+	lookups int32
+}
+
+func (c *countingOverrides) Lookup(ctx context.Context, asn string) (string, error) {
+	atomic.AddInt32(&c.lookups, 1)
+	return c.FileOverrides.Lookup(ctx, asn)
+}
+
+func TestOverridesMirror(t *testing.T) {
+	path := filepath.Join(tempDir(t), "overrides.json")
+	// Replaces the file at once, as refreshed in the background
+	write := func(data string, modTime time.Time) {
+		if err := ioutil.WriteFile(path+".tmp", []byte(data), 0644); err != nil {
+			t.Fatalf("cannot write overrides file: %s", err)
+		}
+		os.Chtimes(path+".tmp", modTime, modTime)
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatalf("cannot write overrides file: %s", err)
+		}
+	}
+	write(`[{"asn": "AS13335", "name": "Cloudflare"}]`, time.Now().Add(-time.Minute))
+	file, err := geoipdb.NewFileOverrides(path, 0)
+	if err != nil {
+		t.Fatalf("NewFileOverrides failed: %s", err)
+	}
+	store := &countingOverrides{FileOverrides: file}
+	mirror := geoipdb.NewOverridesMirror(store, time.Hour)
+	defer mirror.Close()
+	if err := mirror.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	ctx := context.Background()
+	if descr, err := mirror.Lookup(ctx, "AS13335"); err != nil || descr != "Cloudflare" {
+		t.Fatalf("unexpected lookup: %s %v", descr, err)
+	}
+	if _, err := mirror.Lookup(ctx, "AS15169"); err != geoipdb.OverridesAsnNotFoundError {
+		t.Fatalf("unexpected lookup error: %v", err)
+	}
+	if n := atomic.LoadInt32(&store.lookups); n != 0 {
+		t.Fatalf("store queried %d times by mirror lookups", n)
+	}
+
+	// Local changes are applied to the mirror and the store
+	if err := mirror.Set(ctx, "AS15169", "Google"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	if descr, err := mirror.Lookup(ctx, "AS15169"); err != nil || descr != "Google" {
+		t.Fatalf("unexpected lookup after set: %s %v", descr, err)
+	}
+	if err := mirror.Remove(ctx, "AS13335"); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	if _, err := mirror.Lookup(ctx, "AS13335"); err != geoipdb.OverridesAsnNotFoundError {
+		t.Fatalf("unexpected lookup error after removal: %v", err)
+	}
+	want := []geoipdb.AsnOverride{{Asn: "AS15169", Name: "Google"}}
+	if list, err := file.List(ctx); err != nil || !reflect.DeepEqual(list, want) {
+		t.Fatalf("unexpected store overrides: %v %v", list, err)
+	}
+
+	// Remote changes are seen on refresh
+	write(`[{"asn": "AS13335", "name": "Cloudflare, Inc."}]`, time.Now().Add(time.Minute))
+	if err := mirror.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	want = []geoipdb.AsnOverride{{Asn: "AS13335", Name: "Cloudflare, Inc."}}
+	if list, err := mirror.List(ctx); err != nil || !reflect.DeepEqual(list, want) {
+		t.Fatalf("unexpected mirror overrides: %v %v", list, err)
+	}
+	if n := atomic.LoadInt32(&store.lookups); n != 0 {
+		t.Fatalf("store queried %d times by mirror lookups", n)
+	}
+
+	// Broken stores keep the mirror unchanged
+	write("[", time.Now().Add(2*time.Minute))
+	if err := mirror.Refresh(); err == nil {
+		t.Fatalf("malformed file accepted")
+	}
+	if descr, err := mirror.Lookup(ctx, "AS13335"); err != nil || descr != "Cloudflare, Inc." {
+		t.Fatalf("unexpected lookup after failed refresh: %s %v", descr, err)
+	}
+}
+
+// fixedVersionOverrides is a MemoryOverrides with a given version.
+type fixedVersionOverrides struct {
+	*geoipdb.MemoryOverrides
+	version atomic.Value
+}
+
+func (f *fixedVersionOverrides) Version(ctx context.Context) (string, error) {
+	version, _ := f.version.Load().(string)
+	return version, nil
+}
+
+func TestOverridesMirrorVersion(t *testing.T) {
+	ctx := context.Background()
+	store := &fixedVersionOverrides{MemoryOverrides: geoipdb.NewMemoryOverrides()}
+	mirror := geoipdb.NewOverridesMirror(store, time.Hour)
+	defer mirror.Close()
+	lookup := func(want string) {
+		t.Helper()
+		if err := mirror.Refresh(); err != nil {
+			t.Fatalf("Refresh failed: %s", err)
+		}
+		if descr, _ := mirror.Lookup(ctx, "AS1"); descr != want {
+			t.Fatalf("unexpected lookup: %q instead of %q", descr, want)
+		}
+	}
+	// Unknown versions always reload
+	store.Set(ctx, "AS1", "One")
+	lookup("One")
+	store.Set(ctx, "AS1", "Uno")
+	lookup("Uno")
+	// Known versions reload when changed
+	store.version.Store("1")
+	lookup("Uno")
+	store.Set(ctx, "AS1", "Eins")
+	lookup("Uno")
+	store.version.Store("2")
+	lookup("Eins")
+
+	// Unchanged versions reload after a while
+	mirror = geoipdb.NewOverridesMirror(store, time.Millisecond)
+	defer mirror.Close()
+	store.Set(ctx, "AS1", "Un")
+	deadline := time.Now().Add(time.Second)
+	for {
+		descr, _ := mirror.Lookup(ctx, "AS1")
+		if descr == "Un" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected lookup after full refreshes: %q", descr)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOverridesMirrorHandler(t *testing.T) {
+	store := geoipdb.NewMemoryOverrides(geoipdb.AsnOverride{Asn: "AS13335", Name: "Cloudflare"})
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(),
+		geoipdb.WithOverrides(store), geoipdb.WithOverridesMirror(time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	if descr, err := h.OverridesLookup("AS13335"); err != nil || descr != "Cloudflare" {
+		t.Fatalf("unexpected lookup: %s %v", descr, err)
+	}
+	if err := store.Set(context.Background(), "AS15169", "Google"); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		descr, err := h.OverridesLookup("AS15169")
+		if err == nil && descr == "Google" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("remote change not mirrored: %s %v", descr, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOverridesPrefix(t *testing.T) {
+	src := &fakeSource{name: "src", asn: "AS3356", descr: "Level 3", prefix: "8.0.0.0/9"}
+	describer := &batchDescriber{calls: make(map[string]int)}
+	store := geoipdb.NewMemoryPrefixOverrides(geoipdb.PrefixOverride{Prefix: "8.8.8.0/24", Asn: "AS15169", Name: "Google"})
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(src, describer),
+		geoipdb.WithOverrides(geoipdb.NewMemoryOverrides(geoipdb.AsnOverride{Asn: "AS64500", Name: "Overriden"})),
+		geoipdb.WithPrefixOverrides(store))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	expect := func(ip string, asn string, descr string, source string) {
+		t.Helper()
+		info, err := h.LookupAsnInfo(ip)
+		if err != nil || info.Asn != asn || info.Descr != descr || info.Source != source {
+			t.Fatalf("unexpected lookup of %s: %+v %v", ip, info, err)
+		}
+	}
+
+	// Overrides take precedence over sources
+	expect("8.8.8.8", "AS15169", "Google", geoipdb.PrefixOverrideSource)
+	if len(src.ips) != 0 {
+		t.Fatalf("source queried for overriden address: %v", src.ips)
+	}
+	if info, _ := h.LookupAsnInfo("8.8.8.9"); info.Prefix != "8.8.8.0/24" || info.Cache != geoipdb.CacheHit {
+		t.Fatalf("unexpected lookup of overriden prefix: %+v", info)
+	}
+	// Source prefixes containing overrides are not cached
+	expect("8.8.4.4", "AS3356", "Level 3", "src")
+	expect("8.8.4.5", "AS3356", "Level 3", "src")
+	if len(src.ips) != 2 {
+		t.Fatalf("unexpected source queries: %v", src.ips)
+	}
+
+	// Longest prefix wins, and changes purge the cache
+	if err := h.PrefixOverridesSet("8.8.8.8/32", "AS64500", ""); err != nil {
+		t.Fatalf("PrefixOverridesSet failed: %s", err)
+	}
+	if err := h.PrefixOverridesSet("::ffff:8.8.8.7/128", "AS64501", ""); err != nil {
+		t.Fatalf("PrefixOverridesSet failed: %s", err)
+	}
+	expect("8.8.8.8", "AS64500", "Overriden", geoipdb.PrefixOverrideSource)
+	expect("8.8.8.7", "AS64501", "Descr of AS64501", geoipdb.PrefixOverrideSource)
+	expect("8.8.8.9", "AS15169", "Google", geoipdb.PrefixOverrideSource)
+	results := h.LookupAsnBatch([]string{"8.8.8.7", "8.8.8.8"}, geoipdb.BatchOptions{})
+	if results[0].Asn != "AS64501" || results[1].Descr != "Overriden" {
+		t.Fatalf("unexpected batch results: %+v", results)
+	}
+	if err := h.PrefixOverridesRemove("8.8.8.0/24"); err != nil {
+		t.Fatalf("PrefixOverridesRemove failed: %s", err)
+	}
+	expect("8.8.8.9", "AS3356", "Level 3", "src")
+	if _, err := h.PrefixOverridesLookup("8.8.8.9"); err != geoipdb.OverridesPrefixNotFoundError {
+		t.Fatalf("unexpected lookup error: %v", err)
+	}
+	if override, err := h.PrefixOverridesLookup("8.8.8.8"); err != nil || override.Asn != "AS64500" {
+		t.Fatalf("unexpected lookup: %+v %v", override, err)
+	}
+
+	want := []geoipdb.PrefixOverride{
+		{Prefix: "8.8.8.7/32", Asn: "AS64501"},
+		{Prefix: "8.8.8.8/32", Asn: "AS64500"},
+	}
+	if list, err := h.PrefixOverridesList(); err != nil || !reflect.DeepEqual(list, want) {
+		t.Fatalf("unexpected overrides: %v %v", list, err)
+	}
+	if list, _ := store.List(context.Background()); len(list) != len(want) {
+		t.Fatalf("unexpected stored overrides: %v", list)
+	}
+
+	// Malformed overrides are rejected
+	if err := h.PrefixOverridesSet("8.8.8.300/32", "AS1", ""); err != geoipdb.MalformedPrefixError {
+		t.Fatalf("unexpected error for malformed prefix: %v", err)
+	}
+	if err := h.PrefixOverridesSet("8.8.8.0/24", "15169", ""); err != geoipdb.OverridesMalformedAsnError {
+		t.Fatalf("unexpected error for malformed ASN: %v", err)
+	}
+	store.Set(context.Background(), geoipdb.PrefixOverride{Prefix: "8.8.8.0/24", Asn: "15169"})
+	if _, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(), geoipdb.WithPrefixOverrides(store)); err == nil {
+		t.Fatalf("malformed stored override accepted")
+	}
+}
+
+func TestOverridesPrefixRefresh(t *testing.T) {
+	src := &fakeSource{name: "src", asn: "AS3356", descr: "Level 3", prefix: "8.0.0.0/9"}
+	store := geoipdb.NewMemoryPrefixOverrides(geoipdb.PrefixOverride{Prefix: "8.8.8.0/24", Asn: "AS15169", Name: "Google"})
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(src),
+		geoipdb.WithPrefixOverrides(store), geoipdb.WithPrefixOverridesRefresh(time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	if asn, _, err := h.LookupAsn("8.8.8.8"); err != nil || asn != "AS15169" {
+		t.Fatalf("unexpected lookup: %s %v", asn, err)
+	}
+	// Changes made by another process are seen, and purge the cache
+	ctx := context.Background()
+	store.Set(ctx, geoipdb.PrefixOverride{Prefix: "8.8.8.0/24", Asn: "AS64500", Name: "Changed"})
+	deadline := time.Now().Add(time.Second)
+	for {
+		asn, _, err := h.LookupAsn("8.8.8.8")
+		if err == nil && asn == "AS64500" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("remote change not refreshed: %s %v", asn, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store.Remove(ctx, "8.8.8.0/24")
+	deadline = time.Now().Add(time.Second)
+	for {
+		asn, _, err := h.LookupAsn("8.8.8.8")
+		if err == nil && asn == "AS3356" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("remote removal not refreshed: %s %v", asn, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOverridesPrefixNested(t *testing.T) {
+	src := &fakeSource{name: "src", asn: "AS3356", descr: "Level 3"}
+	store := geoipdb.NewMemoryPrefixOverrides(
+		geoipdb.PrefixOverride{Prefix: "1.0.0.0/8", Asn: "AS1", Name: "One"},
+		geoipdb.PrefixOverride{Prefix: "1.1.0.0/16", Asn: "AS2", Name: "Two"},
+	)
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(src), geoipdb.WithPrefixOverrides(store))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	// Answers of the wider override do not hide the nested one
+	for _, ip := range []string{"1.2.3.4", "1.1.2.3", "1.2.3.5", "1.1.2.4"} {
+		want := "AS1"
+		if strings.HasPrefix(ip, "1.1.") {
+			want = "AS2"
+		}
+		if asn, _, err := h.LookupAsn(ip); err != nil || asn != want {
+			t.Fatalf("unexpected lookup of %s: %s %v", ip, asn, err)
+		}
+	}
+	if info, _ := h.LookupAsnInfo("1.1.9.9"); info.Cache != geoipdb.CacheHit {
+		t.Fatalf("nested override not cached: %+v", info)
+	}
+}
+
+func TestOverridesPrefixCanonical(t *testing.T) {
+	store := geoipdb.NewMemoryPrefixOverrides(geoipdb.PrefixOverride{Prefix: "10.1.2.3/8", Asn: "AS1"})
+	ctx := context.Background()
+	store.Set(ctx, geoipdb.PrefixOverride{Prefix: "::ffff:192.0.2.1/120", Asn: "AS2"})
+	want := []geoipdb.PrefixOverride{{Prefix: "10.0.0.0/8", Asn: "AS1"}, {Prefix: "192.0.2.0/24", Asn: "AS2"}}
+	list, err := store.List(ctx)
+	sort.Slice(list, func(i, j int) bool { return list[i].Asn < list[j].Asn })
+	if err != nil || !reflect.DeepEqual(list, want) {
+		t.Fatalf("unexpected overrides: %v %v", list, err)
+	}
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(), geoipdb.WithPrefixOverrides(store))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	if err := h.PrefixOverridesRemove("10.0.0.0/8"); err != nil {
+		t.Fatalf("PrefixOverridesRemove failed: %s", err)
+	}
+	if list, _ := store.List(ctx); !reflect.DeepEqual(list, want[1:]) {
+		t.Fatalf("unexpected overrides after removal: %v", list)
+	}
+}
+
+func TestOverridesPrefixNil(t *testing.T) {
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources())
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	if err := h.PrefixOverridesSet("8.8.8.0/24", "AS15169", ""); err != geoipdb.OverridesNilCollectionError {
+		t.Fatalf("unexpected set error: %v", err)
+	}
+	if _, err := h.PrefixOverridesLookup("8.8.8.8"); err != geoipdb.OverridesPrefixNotFoundError {
+		t.Fatalf("unexpected lookup error: %v", err)
+	}
+}
+
+func TestOverridesExport(t *testing.T) {
+	store := geoipdb.NewMemoryOverrides(
+		geoipdb.AsnOverride{Asn: "AS15169", Name: "Google"},
+		geoipdb.AsnOverride{Asn: "AS13335", Name: "Cloudflare, Inc."},
+	)
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(), geoipdb.WithOverrides(store))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	exports := map[geoipdb.OverridesFormat]string{
+		geoipdb.OverridesJSON: `[
+  {
+    "asn": "AS13335",
+    "name": "Cloudflare, Inc."
+  },
+  {
+    "asn": "AS15169",
+    "name": "Google"
+  }
+]
+`,
+		geoipdb.OverridesCSV: "asn,name\nAS13335,\"Cloudflare, Inc.\"\nAS15169,Google\n",
+	}
+	for format, want := range exports {
+		var buf bytes.Buffer
+		if err := h.OverridesExport(&buf, format); err != nil {
+			t.Fatalf("%s export failed: %s", format, err)
+		}
+		if buf.String() != want {
+			t.Fatalf("unexpected %s export:\n%s", format, buf.String())
+		}
+		// Exports can be imported back
+		report, err := h.OverridesImport(&buf, format, geoipdb.OverridesReplace)
+		if err != nil || report.Unchanged != 2 || report.Added+report.Updated+report.Removed != 0 {
+			t.Fatalf("unexpected %s import: %+v %v", format, report, err)
+		}
+	}
+	if err := h.OverridesExport(ioutil.Discard, "xml"); err != geoipdb.OverridesFormatError {
+		t.Fatalf("unexpected error for unsupported format: %v", err)
+	}
+}
+
+// unbatchedOverrides is an OverridesStore hiding the Apply method
+// of the store it wraps.
+type unbatchedOverrides struct {
+	geoipdb.OverridesStore
+}
+
+func TestOverridesImport(t *testing.T) {
+	store := geoipdb.NewMemoryOverrides(
+		geoipdb.AsnOverride{Asn: "AS1", Name: "One"},
+		geoipdb.AsnOverride{Asn: "AS2", Name: "Two"},
+	)
+	src := &fakeSource{name: "src", asn: "AS1", descr: "Raw"}
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(src),
+		geoipdb.WithOverrides(unbatchedOverrides{store}))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	if _, descr, err := h.LookupAsn("1.1.1.1"); err != nil || descr != "One" {
+		t.Fatalf("unexpected lookup: %s %v", descr, err)
+	}
+	expect := func(want ...geoipdb.AsnOverride) {
+		t.Helper()
+		if list, err := store.List(context.Background()); err != nil || !reflect.DeepEqual(list, want) {
+			t.Fatalf("unexpected overrides: %v %v", list, err)
+		}
+	}
+
+	report, err := h.OverridesImport(strings.NewReader("asn,name\nAS1,Uno\nAS3, Three\nAS2,Two\n"),
+		geoipdb.OverridesCSV, geoipdb.OverridesMerge)
+	want := geoipdb.OverridesImportReport{Added: 1, Updated: 1, Unchanged: 1}
+	if err != nil || !reflect.DeepEqual(report, want) {
+		t.Fatalf("unexpected merge: %+v %v", report, err)
+	}
+	expect(geoipdb.AsnOverride{Asn: "AS1", Name: "Uno"},
+		geoipdb.AsnOverride{Asn: "AS2", Name: "Two"},
+		geoipdb.AsnOverride{Asn: "AS3", Name: "Three"})
+	if _, descr, err := h.LookupAsn("1.1.1.1"); err != nil || descr != "Uno" {
+		t.Fatalf("unexpected lookup after import: %s %v", descr, err)
+	}
+
+	// Dry runs change nothing
+	report, err = h.OverridesImport(strings.NewReader(`[{"asn": "AS4", "name": "Four"}]`),
+		geoipdb.OverridesJSON, geoipdb.OverridesDryRun)
+	if err != nil || report.Added != 1 {
+		t.Fatalf("unexpected dry run: %+v %v", report, err)
+	}
+
+	// Empty descriptions are accepted, as by OverridesSet
+	report, err = h.OverridesImport(strings.NewReader("AS4,\n"), geoipdb.OverridesCSV, geoipdb.OverridesMerge)
+	if err != nil || report.Added != 1 {
+		t.Fatalf("unexpected import of empty description: %+v %v", report, err)
+	}
+	// Only data of changed ASNs are purged from the cache
+	if info, err := h.LookupAsnInfo("1.1.1.1"); err != nil || info.Cache != geoipdb.CacheHit {
+		t.Fatalf("unexpected lookup after unrelated import: %+v %v", info, err)
+	}
+	if _, err := h.OverridesImport(strings.NewReader("AS4,Four\n"), geoipdb.OverridesCSV, 42); err != geoipdb.OverridesImportModeError {
+		t.Fatalf("unexpected error for unsupported mode: %v", err)
+	}
+
+	// Malformed rows are all reported, and nothing is applied
+	report, err = h.OverridesImport(strings.NewReader("AS5,Five\n15169,Google\nAS5,Again\nAS6\n"),
+		geoipdb.OverridesCSV, geoipdb.OverridesMerge)
+	if err != geoipdb.OverridesMalformedRowsError {
+		t.Fatalf("unexpected error for malformed rows: %v", err)
+	}
+	var rows []int
+	for _, rowErr := range report.Errors {
+		rows = append(rows, rowErr.Row)
+	}
+	if !reflect.DeepEqual(rows, []int{2, 3, 4}) || report.Errors[0].Err != geoipdb.OverridesMalformedAsnError {
+		t.Fatalf("unexpected row errors: %v", report.Errors)
+	}
+	if _, err := h.OverridesImport(strings.NewReader(`{"asn": "AS5"}`), geoipdb.OverridesJSON, geoipdb.OverridesMerge); err == nil {
+		t.Fatalf("malformed JSON accepted")
+	}
+
+	report, err = h.OverridesImport(strings.NewReader(`[{"asn": "AS1", "name": "Uno"}]`),
+		geoipdb.OverridesJSON, geoipdb.OverridesReplace)
+	want = geoipdb.OverridesImportReport{Removed: 3, Unchanged: 1}
+	if err != nil || !reflect.DeepEqual(report, want) {
+		t.Fatalf("unexpected replace: %+v %v", report, err)
+	}
+	expect(geoipdb.AsnOverride{Asn: "AS1", Name: "Uno"})
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// OverridesFormat is a serialization format of ASN description overrides
+// (see OverridesExport and OverridesImport).
+type OverridesFormat string
+
+const (
+	// OverridesJSON is a JSON array of AsnOverride objects:
+	//
+	//	[{"asn": "AS13335", "name": "Cloudflare"}]
+	OverridesJSON OverridesFormat = "json"
+	// OverridesCSV is a CSV file with an "asn,name" header line:
+	//
+	//	asn,name
+	//	AS13335,Cloudflare
+	OverridesCSV OverridesFormat = "csv"
+)
+
+// OverridesImportMode tells how OverridesImport applies overrides.
+type OverridesImportMode int
+
+const (
+	// OverridesMerge sets the imported overrides,
+	// keeping the other existing ones.
+	OverridesMerge OverridesImportMode = iota
+	// OverridesReplace sets the imported overrides,
+	// and removes the other existing ones.
+	OverridesReplace
+	// OverridesDryRun only validates the imported overrides,
+	// and reports the changes OverridesMerge would make.
+	OverridesDryRun
+)
+
+var (
+	// OverridesFormatError is returned by OverridesExport and OverridesImport
+	// on unsupported format.
+	OverridesFormatError = errors.New("unsupported overrides format")
+	// OverridesImportModeError is returned by OverridesImport
+	// on unsupported import mode.
+	OverridesImportModeError = errors.New("unsupported overrides import mode")
+	// OverridesMalformedRowsError is returned by OverridesImport
+	// when some imported overrides are malformed
+	// (see OverridesImportReport.Errors).
+	OverridesMalformedRowsError = errors.New("malformed overrides")
+)
+
+// OverridesRowError is the error of a malformed imported override.
+type OverridesRowError struct {
+	// Row is the line number in CSV, or the index from 1 in JSON
+	Row int
+	// ASN identification of the row, as imported
+	Asn string
+	// Err tells why the row is malformed
+	Err error
+}
+
+// Error implements error.
+func (e OverridesRowError) Error() string {
+	return fmt.Sprintf("row %d (%q): %s", e.Row, e.Asn, e.Err)
+}
+
+// OverridesImportReport tells the changes made by OverridesImport.
+type OverridesImportReport struct {
+	// Number of overrides added, updated, removed and left unchanged
+	Added     int
+	Updated   int
+	Removed   int
+	Unchanged int
+	// Errors of malformed rows, if any
+	Errors []OverridesRowError
+}
+
+// overridesBatcher is an OverridesStore applying several changes at once,
+// atomically (see OverridesImport).
+type overridesBatcher interface {
+	// Apply sets and removes overrides.
+	Apply(ctx context.Context, set []AsnOverride, remove []string) error
+}
+
+// applyToStore sets and removes overrides in a store,
+// at once if it supports it, or else one by one.
+func applyToStore(ctx context.Context, store OverridesStore, set []AsnOverride, remove []string) error {
+	if batcher, ok := store.(overridesBatcher); ok {
+		return batcher.Apply(ctx, set, remove)
+	}
+	for _, asn := range remove {
+		if err := store.Remove(ctx, asn); err != nil {
+			return err
+		}
+	}
+	for _, override := range set {
+		if err := store.Set(ctx, override.Asn, override.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importedOverride is an override read by OverridesImport.
+type importedOverride struct {
+	row int
+	AsnOverride
+	// Parse error of the row, if any
+	err error
+}
+
+// readOverrides reads overrides in a given format.
+//
+// Returns an error if r cannot be read or parsed as a whole.
+func readOverrides(r io.Reader, format OverridesFormat) ([]importedOverride, error) {
+	var answer []importedOverride
+	switch format {
+	case OverridesJSON:
+		var overrides []AsnOverride
+		if err := json.NewDecoder(r).Decode(&overrides); err != nil {
+			return nil, err
+		}
+		for i, override := range overrides {
+			answer = append(answer, importedOverride{row: i + 1, AsnOverride: override})
+		}
+	case OverridesCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = 2
+		reader.TrimLeadingSpace = true
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if errors.Is(err, csv.ErrFieldCount) {
+				row, _ := reader.FieldPos(0)
+				answer = append(answer, importedOverride{row: row, AsnOverride: AsnOverride{Asn: record[0]},
+					err: fmt.Errorf("%d fields instead of 2", len(record))})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			row, _ := reader.FieldPos(0)
+			if row == 1 && strings.EqualFold(record[0], "asn") && strings.EqualFold(record[1], "name") {
+				// Header
+				continue
+			}
+			answer = append(answer, importedOverride{row: row, AsnOverride: AsnOverride{Asn: record[0], Name: record[1]}})
+		}
+	default:
+		return nil, OverridesFormatError
+	}
+	return answer, nil
+}
+
+// OverridesExport writes all ASN description overrides,
+// sorted by ASN, in a given format.
+func (h Handler) OverridesExport(w io.Writer, format OverridesFormat) error {
+	return h.OverridesExportContext(context.Background(), w, format)
+}
+
+// OverridesExportContext is like OverridesExport,
+// but gives up when ctx is done.
+func (h Handler) OverridesExportContext(ctx context.Context, w io.Writer, format OverridesFormat) error {
+	if format != OverridesJSON && format != OverridesCSV {
+		return OverridesFormatError
+	}
+	overrides, err := h.OverridesListContext(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].Asn < overrides[j].Asn
+	})
+	if format == OverridesJSON {
+		data, err := json.MarshalIndent(overrides, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"asn", "name"})
+	for _, override := range overrides {
+		writer.Write([]string{override.Asn, override.Name})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// OverridesImport reads ASN description overrides in a given format,
+// and applies them according to mode.
+//
+// Every row is validated beforehand:
+// if any is malformed, e.g. its ASN is not an ASN identification,
+// nothing is applied and the report lists the errors of all such rows.
+// Changes are applied at once, atomically if the overrides store supports it
+// (as MemoryOverrides, FileOverrides and BoltOverrides do).
+//
+// Moreover, this method purges the cache (see LookupAsn)
+// of all data related to the ASNs whose override changed.
+//
+// Returns
+// a report of the changes,
+// and OverridesMalformedRowsError if any row is malformed,
+// OverridesImportModeError if mode is not supported,
+// or an error if r cannot be parsed or the changes cannot be applied.
+func (h Handler) OverridesImport(r io.Reader, format OverridesFormat, mode OverridesImportMode) (OverridesImportReport, error) {
+	return h.OverridesImportContext(context.Background(), r, format, mode)
+}
+
+// OverridesImportContext is like OverridesImport,
+// but gives up when ctx is done.
+func (h Handler) OverridesImportContext(ctx context.Context, r io.Reader, format OverridesFormat, mode OverridesImportMode) (OverridesImportReport, error) {
+	var report OverridesImportReport
+	if h.overrides == nil {
+		return report, OverridesNilCollectionError
+	}
+	switch mode {
+	case OverridesMerge, OverridesReplace, OverridesDryRun:
+	default:
+		return report, OverridesImportModeError
+	}
+	imported, err := readOverrides(r, format)
+	if err == OverridesFormatError {
+		return report, err
+	}
+	if err != nil {
+		return report, fmt.Errorf("cannot parse overrides: %s", err)
+	}
+	// Validate rows
+	rows := make(map[string]int, len(imported))
+	for _, override := range imported {
+		err := override.err
+		switch {
+		case err != nil:
+			// Malformed row
+		case !reASN.MatchString(override.Asn):
+			err = OverridesMalformedAsnError
+		case rows[override.Asn] != 0:
+			err = fmt.Errorf("duplicate of row %d", rows[override.Asn])
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, OverridesRowError{override.row, override.Asn, err})
+			continue
+		}
+		rows[override.Asn] = override.row
+	}
+	if len(report.Errors) > 0 {
+		return report, OverridesMalformedRowsError
+	}
+	// Compare with existing overrides
+	existing, err := h.OverridesListContext(ctx)
+	if err != nil {
+		return report, err
+	}
+	names := make(map[string]string, len(existing))
+	for _, override := range existing {
+		names[override.Asn] = override.Name
+	}
+	var set []AsnOverride
+	for _, override := range imported {
+		name, ok := names[override.Asn]
+		switch {
+		case !ok:
+			report.Added++
+		case name != override.Name:
+			report.Updated++
+		default:
+			report.Unchanged++
+			continue
+		}
+		set = append(set, override.AsnOverride)
+	}
+	var remove []string
+	if mode == OverridesReplace {
+		for _, override := range existing {
+			if _, ok := rows[override.Asn]; !ok {
+				remove = append(remove, override.Asn)
+			}
+		}
+		report.Removed = len(remove)
+	}
+	if mode == OverridesDryRun || len(set)+len(remove) == 0 {
+		return report, nil
+	}
+	err = applyToStore(ctx, h.overrides, set, remove)
+	for _, override := range set {
+		h.cache.purgeASN(override.Asn)
+	}
+	for _, asn := range remove {
+		h.cache.purgeASN(asn)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return report, ctxErr
+		}
+		return report, fmt.Errorf("cannot import overrides: %s", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,590 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/geoipdb/iputils"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PrefixOverrideSource is the AsnInfo.Source of the answers
+// taken from prefix overrides (see WithPrefixOverrides).
+const PrefixOverrideSource = "prefix-override"
+
+// PrefixOverride forces the ASN of the IP addresses of a prefix,
+// as stored by PrefixOverridesStores.
+type PrefixOverride struct {
+	// Prefix in canonical CIDR notation, e.g. "192.0.2.0/24"
+	Prefix string `bson:"_id" json:"prefix" yaml:"prefix"`
+	// ASN identification, e.g. "AS15169"
+	Asn string `bson:"asn" json:"asn" yaml:"asn"`
+	// ASN description, if empty looked up as usual
+	Name string `bson:"name,omitempty" json:"name,omitempty" yaml:"name,omitempty"`
+}
+
+// OverridesPrefixNotFoundError is returned by PrefixOverridesLookup
+// when no prefix override contains the IP address.
+var OverridesPrefixNotFoundError = errors.New("prefix not found")
+
+// PrefixOverridesStore stores the prefix overrides
+// (see WithPrefixOverrides).
+// Implementations must be safe for concurrent use,
+// and should give up when ctx is done.
+type PrefixOverridesStore interface {
+	// Set stores or replaces the override of a prefix.
+	Set(ctx context.Context, override PrefixOverride) error
+	// Remove deletes the override of a prefix, in canonical CIDR notation.
+	// Removing a missing override is not an error.
+	Remove(ctx context.Context, prefix string) error
+	// List retrieves all prefix overrides.
+	List(ctx context.Context) ([]PrefixOverride, error)
+}
+
+// WithPrefixOverrides defines the store of prefix overrides,
+// loaded by NewHandler.
+//
+// The longest prefix override containing an IP address
+// takes precedence over all sources in LookupAsn,
+// e.g. for correcting customer space announced through a transit provider.
+// The ASN description is the one of the override, if not empty,
+// or else looked up like for other answers.
+//
+// Overrides are matched in memory: changes made to the store
+// by other processes are seen by Handlers created afterwards,
+// or on refresh (see WithPrefixOverridesRefresh).
+func WithPrefixOverrides(store PrefixOverridesStore) HandlerOption {
+	return func(h *Handler) {
+		h.routes.store = store
+	}
+}
+
+// WithPrefixOverridesRefresh makes the Handler reload its prefix overrides
+// from their store every interval,
+// and purge the cache (see LookupAsn) of the prefixes that changed,
+// so that changes made by other processes are seen,
+// e.g. when sharing the store and a MongoCache.
+// Zero means DefaultOverridesMirrorInterval.
+// The refreshes are stopped by Handler.Close.
+func WithPrefixOverridesRefresh(interval time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.routes.interval = interval
+		if h.routes.interval <= 0 {
+			h.routes.interval = DefaultOverridesMirrorInterval
+		}
+	}
+}
+
+// routeTable is the in-memory copy of the prefix overrides of a Handler.
+// A nil *routeTable has no overrides.
+type routeTable struct {
+	store PrefixOverridesStore
+	// Refresh period, zero if never refreshed
+	interval time.Duration
+	// Closed to stop the refreshes
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Concurrent access control to the fields below
+	mu sync.RWMutex
+	// Prefix overrides, by prefix
+	table *prefixTable
+	// Prefixes of the overrides, sorted by address then length
+	sorted []netip.Prefix
+	// Count of the overrides set or removed
+	changes int
+}
+
+// newRouteTable returns an empty routeTable.
+func newRouteTable() *routeTable {
+	return &routeTable{table: newPrefixTable(), stop: make(chan struct{})}
+}
+
+// close stops the refreshes of the table.
+func (r *routeTable) close() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+// ipNet converts a canonical prefix to its net form.
+func ipNet(prefix netip.Prefix) *net.IPNet {
+	addr := prefix.Addr()
+	return &net.IPNet{IP: net.IP(addr.AsSlice()), Mask: net.CIDRMask(prefix.Bits(), addr.BitLen())}
+}
+
+// comparePrefixes orders prefixes by address, then by length.
+func comparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// search returns the index of the first sorted prefix
+// not before a given address and length.
+// Caller must hold the lock.
+func (r *routeTable) search(addr netip.Addr, bits int) int {
+	return sort.Search(len(r.sorted), func(i int) bool {
+		if c := r.sorted[i].Addr().Compare(addr); c != 0 {
+			return c > 0
+		}
+		return r.sorted[i].Bits() >= bits
+	})
+}
+
+// load replaces the overrides by the ones of the store,
+// unless overrides were set or removed meanwhile,
+// in which case the table is kept until next load.
+//
+// Returns the prefixes of the overrides added, changed or removed.
+func (r *routeTable) load(ctx context.Context) ([]netip.Prefix, error) {
+	r.mu.RLock()
+	changes := r.changes
+	r.mu.RUnlock()
+	overrides, err := r.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	table := newPrefixTable()
+	sorted := make([]netip.Prefix, 0, len(overrides))
+	for _, override := range overrides {
+		prefix, ok := parsePrefix(override.Prefix)
+		if !ok || !reASN.MatchString(override.Asn) {
+			return nil, fmt.Errorf("malformed prefix override %s %s", override.Prefix, override.Asn)
+		}
+		override.Prefix = prefix.String()
+		if _, dup := table.get(ipNet(prefix)); !dup {
+			sorted = append(sorted, prefix)
+		}
+		table.insert(ipNet(prefix), override)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return comparePrefixes(sorted[i], sorted[j]) < 0
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.changes != changes {
+		// The list may miss the changes
+		return nil, nil
+	}
+	var changed []netip.Prefix
+	for _, prefix := range sorted {
+		value, _ := table.get(ipNet(prefix))
+		if old, ok := r.table.get(ipNet(prefix)); !ok || old != value {
+			changed = append(changed, prefix)
+		}
+	}
+	for _, prefix := range r.sorted {
+		if _, ok := table.get(ipNet(prefix)); !ok {
+			changed = append(changed, prefix)
+		}
+	}
+	r.table, r.sorted = table, sorted
+	return changed, nil
+}
+
+// set adds or replaces the override of a canonical prefix.
+func (r *routeTable) set(prefix netip.Prefix, override PrefixOverride) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes++
+	r.table.insert(ipNet(prefix), override)
+	i := r.search(prefix.Addr(), prefix.Bits())
+	if i < len(r.sorted) && r.sorted[i] == prefix {
+		return
+	}
+	r.sorted = append(r.sorted, netip.Prefix{})
+	copy(r.sorted[i+1:], r.sorted[i:])
+	r.sorted[i] = prefix
+}
+
+// remove deletes the override of a canonical prefix, if any.
+func (r *routeTable) remove(prefix netip.Prefix) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.changes++
+	r.table.remove(ipNet(prefix))
+	i := r.search(prefix.Addr(), prefix.Bits())
+	if i < len(r.sorted) && r.sorted[i] == prefix {
+		r.sorted = append(r.sorted[:i], r.sorted[i+1:]...)
+	}
+}
+
+// match retrieves the longest prefix override containing ip.
+func (r *routeTable) match(ip netip.Addr) (PrefixOverride, bool) {
+	if r == nil {
+		return PrefixOverride{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.table.len() == 0 {
+		return PrefixOverride{}, false
+	}
+	value, ok := r.table.match(ip)
+	if !ok {
+		return PrefixOverride{}, false
+	}
+	return value.(PrefixOverride), true
+}
+
+// shadows tells if prefix overrides would be hidden
+// by caching an answer for a given prefix:
+// for an answer of a prefix override,
+// the more specific overrides contained in the prefix,
+// and otherwise all overrides overlapping the prefix.
+//
+// It costs a match of the prefix address,
+// and a binary search for the overrides it contains.
+func (r *routeTable) shadows(prefix *net.IPNet, override bool) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.table.len() == 0 {
+		return false
+	}
+	p := netipPrefix(prefix)
+	if !override {
+		// Overrides containing the prefix address overlap it
+		if _, ok := r.table.match(p.Addr()); ok {
+			return true
+		}
+	}
+	// More specific overrides contained in the prefix follow it
+	i := r.search(p.Addr(), p.Bits()+1)
+	return i < len(r.sorted) && p.Contains(r.sorted[i].Addr())
+}
+
+// list answers all prefix overrides, sorted by prefix.
+func (r *routeTable) list() []PrefixOverride {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	answer := make([]PrefixOverride, 0, len(r.sorted))
+	for _, prefix := range r.sorted {
+		value, _ := r.table.get(ipNet(prefix))
+		answer = append(answer, value.(PrefixOverride))
+	}
+	return answer
+}
+
+// info answers the ASN data of the IP addresses of override,
+// with description not yet looked up if the override has none.
+func (override PrefixOverride) info() AsnInfo {
+	info := AsnInfo{
+		Asn:    override.Asn,
+		Descr:  override.Name,
+		Source: PrefixOverrideSource,
+		Prefix: override.Prefix,
+	}.normalized()
+	if override.Name != "" {
+		info.RawDescr = ""
+		info.Overriden = true
+	}
+	return info
+}
+
+// routeInfo answers the ASN data of the IP addresses of override,
+// described by the sources if the override has no description.
+// The description is not yet overriden.
+func (h Handler) routeInfo(ctx context.Context, override PrefixOverride) AsnInfo {
+	info := override.info()
+	if info.Descr == "" {
+		info.Descr = h.describeAsn(ctx, info.Asn)
+		info.RawDescr = info.Descr
+	}
+	return info
+}
+
+// PrefixOverridesLookup answers the longest prefix override
+// containing a given IP address.
+//
+// Returns MalformedIPError if ip is not an IP address,
+// or OverridesPrefixNotFoundError if no prefix override contains it.
+func (h Handler) PrefixOverridesLookup(ip string) (PrefixOverride, error) {
+	addr, ok := iputils.ParseAddr(ip)
+	if !ok {
+		return PrefixOverride{}, MalformedIPError
+	}
+	override, ok := h.routes.match(addr)
+	if !ok {
+		return PrefixOverride{}, OverridesPrefixNotFoundError
+	}
+	return override, nil
+}
+
+// PrefixOverridesSet stores or updates the ASN, and optionally
+// the description, of the IP addresses of a prefix in CIDR notation
+// (see WithPrefixOverrides).
+//
+// Moreover, this method purges the cache (see LookupAsn)
+// of all data related to the prefixes overlapping cidr.
+func (h Handler) PrefixOverridesSet(cidr string, asn string, descr string) error {
+	return h.PrefixOverridesSetContext(context.Background(), cidr, asn, descr)
+}
+
+// PrefixOverridesSetContext is like PrefixOverridesSet,
+// but gives up when ctx is done.
+func (h Handler) PrefixOverridesSetContext(ctx context.Context, cidr string, asn string, descr string) error {
+	if h.routes == nil || h.routes.store == nil {
+		return OverridesNilCollectionError
+	}
+	prefix, ok := parsePrefix(cidr)
+	if !ok {
+		return MalformedPrefixError
+	}
+	if !reASN.MatchString(asn) {
+		return OverridesMalformedAsnError
+	}
+	override := PrefixOverride{Prefix: prefix.String(), Asn: asn, Name: descr}
+	if err := h.routes.store.Set(ctx, override); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("cannot set prefix override: %s", err)
+	}
+	h.routes.set(prefix, override)
+	h.purgeRoute(prefix)
+	return nil
+}
+
+// PrefixOverridesRemove removes the override of a prefix in CIDR notation.
+// If there is no such override,
+// PrefixOverridesRemove returns silently without error.
+//
+// Moreover, this method purges the cache (see LookupAsn)
+// of all data related to the prefixes overlapping cidr.
+func (h Handler) PrefixOverridesRemove(cidr string) error {
+	return h.PrefixOverridesRemoveContext(context.Background(), cidr)
+}
+
+// PrefixOverridesRemoveContext is like PrefixOverridesRemove,
+// but gives up when ctx is done.
+func (h Handler) PrefixOverridesRemoveContext(ctx context.Context, cidr string) error {
+	if h.routes == nil || h.routes.store == nil {
+		return OverridesNilCollectionError
+	}
+	prefix, ok := parsePrefix(cidr)
+	if !ok {
+		return MalformedPrefixError
+	}
+	if err := h.routes.store.Remove(ctx, prefix.String()); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("cannot remove prefix override: %s", err)
+	}
+	h.routes.remove(prefix)
+	h.purgeRoute(prefix)
+	return nil
+}
+
+// PrefixOverridesList answers all prefix overrides, sorted by prefix.
+func (h Handler) PrefixOverridesList() ([]PrefixOverride, error) {
+	if h.routes == nil || h.routes.store == nil {
+		return nil, OverridesNilCollectionError
+	}
+	return h.routes.list(), nil
+}
+
+// purgeRoute purges the cache entries overlapping
+// a changed prefix override,
+// or the whole cache if the backend cannot purge prefixes.
+func (h Handler) purgeRoute(prefix netip.Prefix) {
+	err := h.purgePrefix(prefix)
+	if err == CacheBackendUnsupportedError {
+		h.AsnCachePurge()
+		return
+	}
+	if err != nil {
+		h.logger.log(LogWarn, "cannot purge prefix override", LogField{"prefix", prefix.String()}, LogField{"err", err})
+	}
+}
+
+// loadRoutes loads the prefix overrides of the Handler store,
+// bounded by the Handler timeout.
+//
+// Returns the prefixes of the overrides added, changed or removed.
+func (h Handler) loadRoutes() ([]netip.Prefix, error) {
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	prefixes, err := h.routes.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load prefix overrides: %s", err)
+	}
+	return prefixes, nil
+}
+
+// pollRoutes reloads the prefix overrides every interval
+// and purges the cache of the changed ones,
+// until the Handler is closed.
+func (h Handler) pollRoutes() {
+	ticker := time.NewTicker(h.routes.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.routes.stop:
+			return
+		}
+		prefixes, err := h.loadRoutes()
+		if err != nil {
+			h.logger.log(LogWarn, "cannot refresh prefix overrides", LogField{"err", err})
+			continue
+		}
+		for _, prefix := range prefixes {
+			h.purgeRoute(prefix)
+		}
+	}
+}
+
+// MemoryPrefixOverrides is a PrefixOverridesStore
+// keeping overrides in memory, for the lifetime of the process.
+type MemoryPrefixOverrides struct {
+	// Concurrent access control to overrides
+	mu sync.RWMutex
+	// Prefix overrides, by prefix
+	overrides map[string]PrefixOverride
+}
+
+// NewMemoryPrefixOverrides returns a MemoryPrefixOverrides
+// holding a given list of overrides.
+// Prefixes are stored in canonical CIDR notation.
+func NewMemoryPrefixOverrides(overrides ...PrefixOverride) *MemoryPrefixOverrides {
+	m := &MemoryPrefixOverrides{overrides: make(map[string]PrefixOverride)}
+	for _, override := range overrides {
+		override.Prefix = canonicalPrefix(override.Prefix)
+		m.overrides[override.Prefix] = override
+	}
+	return m
+}
+
+// canonicalPrefix answers a prefix in canonical CIDR notation,
+// or unchanged if malformed.
+func canonicalPrefix(cidr string) string {
+	if prefix, ok := parsePrefix(cidr); ok {
+		return prefix.String()
+	}
+	return cidr
+}
+
+// Set implements PrefixOverridesStore.
+func (m *MemoryPrefixOverrides) Set(ctx context.Context, override PrefixOverride) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	override.Prefix = canonicalPrefix(override.Prefix)
+	m.overrides[override.Prefix] = override
+	return nil
+}
+
+// Remove implements PrefixOverridesStore.
+func (m *MemoryPrefixOverrides) Remove(ctx context.Context, prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.overrides, canonicalPrefix(prefix))
+	return nil
+}
+
+// List implements PrefixOverridesStore.
+func (m *MemoryPrefixOverrides) List(ctx context.Context) ([]PrefixOverride, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	answer := make([]PrefixOverride, 0, len(m.overrides))
+	for _, override := range m.overrides {
+		answer = append(answer, override)
+	}
+	return answer, nil
+}
+
+// MongoPrefixOverrides is a PrefixOverridesStore
+// backed by a MongoDB collection.
+type MongoPrefixOverrides struct {
+	mongo MongoOverrides
+}
+
+// NewMongoPrefixOverrides returns a PrefixOverridesStore
+// backed by a given collection.
+// Prefixes are stored in canonical CIDR notation.
+func NewMongoPrefixOverrides(coll *mgo.Collection) *MongoPrefixOverrides {
+	return &MongoPrefixOverrides{mongo: MongoOverrides{coll: coll}}
+}
+
+// Set implements PrefixOverridesStore.
+func (m *MongoPrefixOverrides) Set(ctx context.Context, override PrefixOverride) error {
+	return m.mongo.with(ctx, func(c *mgo.Collection) error {
+		_, err := c.UpsertId(canonicalPrefix(override.Prefix), bson.M{"$set": bson.M{
+			"asn":     override.Asn,
+			"name":    override.Name,
+			"updated": time.Now(),
+		}})
+		return err
+	})
+}
+
+// Remove implements PrefixOverridesStore.
+func (m *MongoPrefixOverrides) Remove(ctx context.Context, prefix string) error {
+	err := m.mongo.with(ctx, func(c *mgo.Collection) error {
+		return c.RemoveId(canonicalPrefix(prefix))
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// List implements PrefixOverridesStore.
+func (m *MongoPrefixOverrides) List(ctx context.Context) ([]PrefixOverride, error) {
+	// Decoded by f only, which may outlive a done ctx
+	found := make(chan []PrefixOverride, 1)
+	err := m.mongo.with(ctx, func(c *mgo.Collection) error {
+		var answer []PrefixOverride
+		if err := c.Find(nil).All(&answer); err != nil {
+			return err
+		}
+		found <- answer
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return <-found, nil
+}
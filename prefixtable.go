@@ -0,0 +1,214 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"net"
+	"net/netip"
+)
+
+// prefixTable maps IP prefixes to values,
+// and finds the longest prefix matching an IP address.
+//
+// It keeps a hash map per address family and prefix length,
+// so a lookup costs at most one map access per prefix length in use.
+// A prefixTable is not safe for concurrent use.
+type prefixTable struct {
+	// Masked IPv4 address to value, by prefix length
+	v4 []map[prefixKey]interface{}
+	// Masked IPv6 address to value, by prefix length
+	v6 []map[prefixKey]interface{}
+	// Number of prefixes in use, by address family and prefix length
+	lengths4 []int
+	lengths6 []int
+	// Number of stored prefixes
+	size int
+}
+
+// prefixKey is the masked address of a prefix, in its 16 bytes form.
+type prefixKey [net.IPv6len]byte
+
+// newPrefixTable returns an empty initialized prefixTable.
+func newPrefixTable() *prefixTable {
+	return &prefixTable{
+		v4:       make([]map[prefixKey]interface{}, 8*net.IPv4len+1),
+		v6:       make([]map[prefixKey]interface{}, 8*net.IPv6len+1),
+		lengths4: make([]int, 8*net.IPv4len+1),
+		lengths6: make([]int, 8*net.IPv6len+1),
+	}
+}
+
+// family returns the maps and length counters for a given IP address,
+// and the address in its 4 bytes form for IPv4.
+//
+// Returns nil maps if ip is not a valid address.
+func (t *prefixTable) family(ip net.IP) ([]map[prefixKey]interface{}, []int, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4, t.lengths4, ip4
+	}
+	if len(ip) == net.IPv6len {
+		return t.v6, t.lengths6, ip
+	}
+	return nil, nil, nil
+}
+
+// keyOf returns the key of ip masked to a given prefix length.
+func keyOf(ip net.IP, ones int) prefixKey {
+	var key prefixKey
+	copy(key[:], ip)
+	return key.masked(ones)
+}
+
+// masked returns key with bits past a given prefix length cleared.
+func (key prefixKey) masked(ones int) prefixKey {
+	if ones < 8*len(key) {
+		key[ones/8] &^= 0xff >> uint(ones%8)
+		for i := ones/8 + 1; i < len(key); i++ {
+			key[i] = 0
+		}
+	}
+	return key
+}
+
+// locate returns the maps, length counters, prefix length and key
+// of a given prefix.
+//
+// Returns nil maps if prefix is not valid.
+func (t *prefixTable) locate(prefix *net.IPNet) ([]map[prefixKey]interface{}, []int, int, prefixKey) {
+	if prefix == nil {
+		return nil, nil, 0, prefixKey{}
+	}
+	maps, lengths, ip := t.family(prefix.IP)
+	ones, bits := prefix.Mask.Size()
+	if maps == nil || bits != 8*len(ip) {
+		return nil, nil, 0, prefixKey{}
+	}
+	return maps, lengths, ones, keyOf(ip, ones)
+}
+
+// insert associates a value with a given prefix,
+// replacing any previous value.
+func (t *prefixTable) insert(prefix *net.IPNet, value interface{}) {
+	maps, lengths, ones, key := t.locate(prefix)
+	if maps == nil {
+		return
+	}
+	if maps[ones] == nil {
+		maps[ones] = make(map[prefixKey]interface{})
+	}
+	if _, ok := maps[ones][key]; !ok {
+		lengths[ones]++
+		t.size++
+	}
+	maps[ones][key] = value
+}
+
+// remove deletes the value associated with a given prefix, if any.
+func (t *prefixTable) remove(prefix *net.IPNet) {
+	maps, lengths, ones, key := t.locate(prefix)
+	if maps == nil {
+		return
+	}
+	if _, ok := maps[ones][key]; !ok {
+		return
+	}
+	delete(maps[ones], key)
+	lengths[ones]--
+	t.size--
+}
+
+// get retrieves the value associated with exactly a given prefix.
+func (t *prefixTable) get(prefix *net.IPNet) (interface{}, bool) {
+	maps, _, ones, key := t.locate(prefix)
+	if maps == nil {
+		return nil, false
+	}
+	value, ok := maps[ones][key]
+	return value, ok
+}
+
+// match retrieves the value associated with
+// the longest prefix containing a given IP address.
+// It does not allocate.
+//
+// Returns
+// the value,
+// and if a prefix was found.
+func (t *prefixTable) match(ip netip.Addr) (interface{}, bool) {
+	var key prefixKey
+	maps, lengths := t.v6, t.lengths6
+	if ip = ip.Unmap(); ip.Is4() {
+		maps, lengths = t.v4, t.lengths4
+		ip4 := ip.As4()
+		copy(key[:], ip4[:])
+	} else if ip.Is6() {
+		key = ip.As16()
+	} else {
+		return nil, false
+	}
+	for ones := len(maps) - 1; ones >= 0; ones-- {
+		if lengths[ones] == 0 {
+			continue
+		}
+		if value, ok := maps[ones][key.masked(ones)]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// walk calls f for each prefix in the table, in no particular order,
+// until f returns false.
+func (t *prefixTable) walk(f func(prefix *net.IPNet, value interface{}) bool) {
+	families := []struct {
+		maps []map[prefixKey]interface{}
+		size int
+	}{
+		{t.v4, net.IPv4len},
+		{t.v6, net.IPv6len},
+	}
+	for _, family := range families {
+		for ones, m := range family.maps {
+			for key, value := range m {
+				ip := net.IP(append([]byte(nil), key[:family.size]...))
+				prefix := &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 8*family.size)}
+				if !f(prefix, value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// clear removes all prefixes from the table.
+func (t *prefixTable) clear() {
+	*t = *newPrefixTable()
+}
+
+// len returns the number of prefixes in the table.
+func (t *prefixTable) len() int {
+	return t.size
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"iter"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/turbobytes/geoipdb/iputils"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CachedIP is what the LookupAsn cache knows about an IP address
+// (see CacheEntries).
+type CachedIP struct {
+	// IP address, in canonical form,
+	// or empty if no lookup within Prefix is recorded
+	IP string
+	// Prefix of the cache entry answering IP, in CIDR notation
+	Prefix string
+	// ASN data, empty if Negative
+	Asn    string
+	Descr  string
+	Source string
+	// Negative tells that no source knows the ASN of IP.
+	Negative bool
+	// Inserted is when the entry was stored.
+	Inserted time.Time
+	// Expires is when the data expires.
+	Expires time.Time
+	// Hits is the number of lookups answered by the entry,
+	// across all its IP addresses,
+	// if counted by the cache backend (not MongoCache).
+	Hits uint64
+}
+
+// cacheInspector is a CacheBackend supporting fine-grained purges
+// and listing of its entries (see CacheEntries).
+type cacheInspector interface {
+	// PurgePrefix removes the entries of prefixes overlapping a given one,
+	// that is containing it or contained in it.
+	PurgePrefix(prefix netip.Prefix) error
+	// PurgeInsertedBefore removes the entries inserted before a given date.
+	PurgeInsertedBefore(t time.Time) error
+	// Entries calls f for each entry, with its IP addresses,
+	// until f returns false.
+	Entries(f func(CacheEntry) bool) error
+}
+
+// PurgeIP erases the LookupAsn cached data answering a given IP address,
+// that is the entries of all cached prefixes containing it.
+//
+// Returns MalformedIPError if ip is not an IP address,
+// or CacheBackendUnsupportedError if the cache backend
+// has no PurgePrefix method (as MemoryCache and MongoCache have).
+func (h Handler) PurgeIP(ip string) error {
+	addr, ok := iputils.ParseAddr(ip)
+	if !ok {
+		return MalformedIPError
+	}
+	return h.purgePrefix(netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// PurgePrefix erases the LookupAsn cached data
+// of the prefixes overlapping a given one, in CIDR notation:
+// the more specific prefixes it contains,
+// and the less specific prefixes containing it.
+//
+// Returns MalformedPrefixError if cidr is not an IP prefix,
+// or CacheBackendUnsupportedError if the cache backend
+// has no PurgePrefix method (as MemoryCache and MongoCache have).
+func (h Handler) PurgePrefix(cidr string) error {
+	prefix, ok := parsePrefix(cidr)
+	if !ok {
+		return MalformedPrefixError
+	}
+	return h.purgePrefix(prefix)
+}
+
+// parsePrefix parses a prefix in CIDR notation, in canonical form:
+// masked, and unmapped if an IPv4-mapped IPv6 prefix.
+//
+// Returns
+// the prefix,
+// and if cidr is a valid prefix.
+func parsePrefix(cidr string) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), true
+}
+
+// purgePrefix removes the cache entries overlapping a canonical prefix.
+func (h Handler) purgePrefix(prefix netip.Prefix) error {
+	inspector, ok := h.cache.backend.(cacheInspector)
+	if !ok {
+		return CacheBackendUnsupportedError
+	}
+	h.logger.log(LogInfo, "cache purge", LogField{"prefix", prefix.String()})
+	return inspector.PurgePrefix(prefix)
+}
+
+// PurgeOlderThan erases the LookupAsn cached data
+// stored more than a given duration ago.
+//
+// Returns CacheBackendUnsupportedError if the cache backend
+// has no PurgeInsertedBefore method (as MemoryCache and MongoCache have).
+func (h Handler) PurgeOlderThan(d time.Duration) error {
+	inspector, ok := h.cache.backend.(cacheInspector)
+	if !ok {
+		return CacheBackendUnsupportedError
+	}
+	h.logger.log(LogInfo, "cache purge", LogField{"age", d})
+	return inspector.PurgeInsertedBefore(time.Now().Add(-d))
+}
+
+// CacheEntries iterates over what the LookupAsn cache knows,
+// IP address by IP address, in no particular order:
+//
+//	for entry := range h.CacheEntries() {
+//		fmt.Println(entry.IP, entry.Asn, entry.Expires)
+//	}
+//
+// Expired entries still in their stale period are included
+// (see CacheConfig.MaxStale).
+// Nothing is yielded if the cache backend
+// has no Entries method (as MemoryCache and MongoCache have).
+func (h Handler) CacheEntries() iter.Seq[CachedIP] {
+	return func(yield func(CachedIP) bool) {
+		inspector, ok := h.cache.backend.(cacheInspector)
+		if !ok {
+			h.logger.log(LogWarn, "cannot list cache entries", LogField{"err", CacheBackendUnsupportedError})
+			return
+		}
+		err := inspector.Entries(func(entry CacheEntry) bool {
+			cached := CachedIP{
+				Prefix:   entry.Prefix.String(),
+				Asn:      entry.Info.Asn,
+				Descr:    entry.Info.Descr,
+				Source:   entry.Info.Source,
+				Negative: entry.Negative,
+				Inserted: entry.Inserted,
+				Expires:  entry.Expires,
+				Hits:     entry.Hits,
+			}
+			if len(entry.IPs) == 0 {
+				return yield(cached)
+			}
+			for _, ip := range entry.IPs {
+				cached.IP = ip
+				if !yield(cached) {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			h.logger.log(LogWarn, "cannot list cache entries", LogField{"err", err})
+		}
+	}
+}
+
+// netipPrefix converts a prefix to its canonical netip form.
+func netipPrefix(prefix *net.IPNet) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(prefix.IP)
+	ones, bits := prefix.Mask.Size()
+	if addr.Is4In6() && bits == 8*net.IPv6len {
+		return netip.PrefixFrom(addr.Unmap(), ones-96)
+	}
+	return netip.PrefixFrom(addr.Unmap(), ones)
+}
+
+// PurgePrefix implements cacheInspector.
+func (m *MemoryCache) PurgePrefix(prefix netip.Prefix) error {
+	// Entries overlapping a prefix at least as long as a bucket
+	// are in its bucket shard, or else in the wide one.
+	shards := m.all()
+	if prefix.Addr().Is4() && prefix.Bits() >= bucketOnes4 || prefix.Addr().Is6() && prefix.Bits() >= bucketOnes6 {
+		shards = []*memShard{m.bucketShard(prefix.Addr()), m.wide}
+	}
+	for _, s := range shards {
+		s.purge(func(entry *memEntry) bool {
+			return netipPrefix(entry.Prefix).Overlaps(prefix)
+		})
+	}
+	return nil
+}
+
+// PurgeInsertedBefore implements cacheInspector.
+func (m *MemoryCache) PurgeInsertedBefore(t time.Time) error {
+	for _, s := range m.all() {
+		s.purge(func(entry *memEntry) bool {
+			return entry.Inserted.Before(t)
+		})
+	}
+	return nil
+}
+
+// purge removes the entries of s for which f returns true.
+func (s *memShard) purge(f func(*memEntry) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.lru.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*memEntry); f(entry) {
+			s.remove(entry)
+		}
+		e = next
+	}
+}
+
+// Entries implements cacheInspector.
+// Entries are copied beforehand, so that f may use the cache.
+func (m *MemoryCache) Entries(f func(CacheEntry) bool) error {
+	for _, entry := range m.entries() {
+		if !f(entry) {
+			break
+		}
+	}
+	return nil
+}
+
+// PurgePrefix implements cacheInspector.
+// It scans the keys of all entries.
+func (m *MongoCache) PurgePrefix(prefix netip.Prefix) error {
+	return m.with(func(c *mgo.Collection) error {
+		var doc mongoCacheDoc
+		var keys []string
+		it := c.Find(nil).Select(bson.M{"_id": 1}).Iter()
+		for it.Next(&doc) {
+			entryPrefix, err := netip.ParsePrefix(doc.Prefix)
+			if err == nil && entryPrefix.Overlaps(prefix) {
+				keys = append(keys, doc.Prefix)
+			}
+		}
+		if err := it.Close(); err != nil || len(keys) == 0 {
+			return err
+		}
+		_, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": keys}})
+		return err
+	})
+}
+
+// PurgeInsertedBefore implements cacheInspector.
+func (m *MongoCache) PurgeInsertedBefore(t time.Time) error {
+	return m.with(func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(bson.M{"inserted": bson.M{"$lt": t}})
+		return err
+	})
+}
+
+// Entries implements cacheInspector.
+func (m *MongoCache) Entries(f func(CacheEntry) bool) error {
+	return m.with(func(c *mgo.Collection) error {
+		it := c.Find(bson.M{"due": bson.M{"$gt": time.Now()}}).Iter()
+		for {
+			var doc mongoCacheDoc
+			if !it.Next(&doc) {
+				break
+			}
+			entry, err := doc.entry()
+			if err != nil {
+				continue
+			}
+			if !f(entry) {
+				break
+			}
+		}
+		return it.Close()
+	})
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newPurgeHandler returns a Handler without sources,
+// whose cache knows about a few prefixes.
+func newPurgeHandler(t *testing.T) Handler {
+	h, err := NewHandler(nil, 0, WithCache(CacheConfig{NegativeTTL: time.Hour, SweepInterval: -1}), WithSources())
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	h.cache.store(netip.MustParseAddr("1.0.0.3"), AsnInfo{Asn: "AS13335", Source: "fake", Prefix: "1.0.0.0/24"})
+	h.cache.store(netip.MustParseAddr("1.0.0.4"), AsnInfo{Asn: "AS13335", Source: "fake", Prefix: "1.0.0.0/24"})
+	h.cache.store(netip.MustParseAddr("1.0.4.1"), AsnInfo{Asn: "AS13335", Source: "fake", Prefix: "1.0.0.0/8"})
+	h.cache.store(netip.MustParseAddr("8.8.8.8"), AsnInfo{Asn: "AS15169", Source: "fake", Prefix: "8.8.8.0/24"})
+	h.cache.store(netip.MustParseAddr("2001:4860::1"), AsnInfo{Asn: "AS15169", Source: "fake"})
+	h.cache.storeError(netip.MustParseAddr("45.45.45.45"), unknownAsnError("45.45.45.45"))
+	return h
+}
+
+// cachedPrefixes returns the sorted prefixes known to the cache of h.
+func cachedPrefixes(h Handler) string {
+	prefixes := make(map[string]interface{})
+	for entry := range h.CacheEntries() {
+		prefixes[entry.Prefix] = nil
+	}
+	var answer []string
+	for prefix := range prefixes {
+		answer = append(answer, prefix)
+	}
+	sort.Strings(answer)
+	return fmt.Sprint(answer)
+}
+
+func TestPurgePrefix(t *testing.T) {
+	h := newPurgeHandler(t)
+	defer h.Close()
+	tests := []struct {
+		purge    func() error
+		expected string
+	}{
+		// Overlapping prefixes are purged, in both directions.
+		{func() error { return h.PurgeIP("1.0.0.200") }, "[2001:4860::1/128 45.45.45.45/32 8.8.8.0/24]"},
+		{func() error { return h.PurgePrefix("::ffff:8.8.0.0/112") }, "[2001:4860::1/128 45.45.45.45/32]"},
+		{func() error { return h.PurgePrefix("2001:4860::/32") }, "[45.45.45.45/32]"},
+		{func() error { return h.PurgeIP("45.45.45.45") }, "[]"},
+	}
+	for i, test := range tests {
+		if err := test.purge(); err != nil {
+			t.Fatalf("purge %d failed: %s", i, err)
+		}
+		if prefixes := cachedPrefixes(h); prefixes != test.expected {
+			t.Fatalf("unexpected prefixes after purge %d: %s", i, prefixes)
+		}
+		checkCacheIndexes(t, h.cache)
+	}
+	if err := h.PurgeIP("1.0.0"); err != MalformedIPError {
+		t.Fatalf("unexpected error for malformed IP: %v", err)
+	}
+	if err := h.PurgePrefix("1.0.0.0/33"); err != MalformedPrefixError {
+		t.Fatalf("unexpected error for malformed prefix: %v", err)
+	}
+}
+
+func TestPurgeOlderThan(t *testing.T) {
+	h := newPurgeHandler(t)
+	defer h.Close()
+	if err := h.PurgeOlderThan(time.Hour); err != nil {
+		t.Fatalf("PurgeOlderThan failed: %s", err)
+	}
+	if n := memoryBackend(h.cache).Len(); n != 5 {
+		t.Fatalf("recent entries purged: %d left", n)
+	}
+	time.Sleep(10 * time.Millisecond)
+	h.cache.store(netip.MustParseAddr("9.9.9.9"), AsnInfo{Asn: "AS19281", Source: "fake"})
+	if err := h.PurgeOlderThan(5 * time.Millisecond); err != nil {
+		t.Fatalf("PurgeOlderThan failed: %s", err)
+	}
+	if prefixes := cachedPrefixes(h); prefixes != "[9.9.9.9/32]" {
+		t.Fatalf("unexpected prefixes after purge: %s", prefixes)
+	}
+	checkCacheIndexes(t, h.cache)
+}
+
+func TestCacheEntries(t *testing.T) {
+	h := newPurgeHandler(t)
+	defer h.Close()
+	for i := 0; i < 3; i++ {
+		if asn, _, err := h.LookupAsn("1.0.0.9"); err != nil || asn != "AS13335" {
+			t.Fatalf("unexpected LookupAsn result: %s %v", asn, err)
+		}
+	}
+	entries := make(map[string]CachedIP)
+	for entry := range h.CacheEntries() {
+		entries[entry.IP] = entry
+	}
+	if len(entries) != 6 {
+		t.Fatalf("unexpected number of cached IPs: %d", len(entries))
+	}
+	for _, ip := range []string{"1.0.0.3", "1.0.0.4"} {
+		entry := entries[ip]
+		if entry.Prefix != "1.0.0.0/24" || entry.Asn != "AS13335" || entry.Source != "fake" || entry.Hits != 3 {
+			t.Fatalf("unexpected entry of %s: %+v", ip, entry)
+		}
+		if d := entry.Expires.Sub(entry.Inserted); d < DefaultCacheTTL-time.Second || d > DefaultCacheTTL {
+			t.Fatalf("unexpected lifetime of %s: %s", ip, d)
+		}
+	}
+	if entry := entries["45.45.45.45"]; !entry.Negative || entry.Asn != "" {
+		t.Fatalf("unexpected negative entry: %+v", entry)
+	}
+	// Iteration stops early.
+	var n int
+	for range h.CacheEntries() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Fatalf("iteration not stopped")
+	}
+}
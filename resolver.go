@@ -0,0 +1,176 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultResolvConf is the resolver configuration file
+// read by default by NewDnsResolver.
+const DefaultResolvConf = "/etc/resolv.conf"
+
+// LocalResolver is the address of a recursive resolver
+// running on the local host, such as unbound or dnsmasq.
+const LocalResolver = "127.0.0.1:53"
+
+// fallbackResolver is the DNS server queried when no other is configured
+// (Google public DNS).
+const fallbackResolver = "8.8.8.8:53"
+
+// DnsResolverConfig configures a DnsResolver.
+type DnsResolverConfig struct {
+	// Servers are the addresses of the recursive resolvers to be queried,
+	// in order of preference.
+	// Port 53 is assumed if an address has no port.
+	//
+	// If empty, the nameservers of ResolvConf are used,
+	// or Google public DNS if ResolvConf is not set and
+	// DefaultResolvConf cannot be read.
+	Servers []string
+	// ResolvConf is the path of the resolver configuration file
+	// read when Servers is empty.
+	// Empty means DefaultResolvConf.
+	ResolvConf string
+	// TCP forces queries over TCP.
+	// Otherwise, queries are sent over UDP
+	// and retried over TCP when answers are truncated.
+	TCP bool
+	// Timeout limits the duration of each query attempt.
+	// Zero disables timeout.
+	Timeout time.Duration
+}
+
+// DnsResolver sends DNS queries to a list of recursive resolvers,
+// failing over to the next resolver when one does not answer.
+// It is safe for concurrent use.
+type DnsResolver struct {
+	servers []string
+	udp     *dns.Client
+	tcp     *dns.Client
+	// Never query over UDP
+	forceTCP bool
+}
+
+// NewDnsResolver creates a DnsResolver.
+func NewDnsResolver(cfg DnsResolverConfig) (*DnsResolver, error) {
+	var servers []string
+	for _, server := range cfg.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		path := cfg.ResolvConf
+		if path == "" {
+			path = DefaultResolvConf
+		}
+		conf, err := dns.ClientConfigFromFile(path)
+		if err != nil && cfg.ResolvConf != "" {
+			return nil, fmt.Errorf("cannot read resolver configuration: %s", err)
+		}
+		if err == nil {
+			for _, server := range conf.Servers {
+				servers = append(servers, net.JoinHostPort(server, conf.Port))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{fallbackResolver}
+	}
+	return &DnsResolver{
+		servers:  servers,
+		udp:      &dns.Client{Net: "udp", Timeout: cfg.Timeout},
+		tcp:      &dns.Client{Net: "tcp", Timeout: cfg.Timeout},
+		forceTCP: cfg.TCP,
+	}, nil
+}
+
+// newDefaultDnsResolver creates a DnsResolver
+// querying the nameservers of DefaultResolvConf.
+func newDefaultDnsResolver(timeout time.Duration) *DnsResolver {
+	r, err := NewDnsResolver(DnsResolverConfig{Timeout: timeout})
+	if err != nil {
+		// Cannot happen without an explicit ResolvConf.
+		panic(err)
+	}
+	return r
+}
+
+// Servers answers the addresses of the resolvers, in order of preference.
+func (r *DnsResolver) Servers() []string {
+	return append([]string{}, r.servers...)
+}
+
+// exchange sends a query to the resolvers in order,
+// until one of them answers.
+// Resolvers answering SERVFAIL or REFUSED are skipped.
+// The query is abandoned when ctx is done.
+//
+// Returns the answer.
+func (r *DnsResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, server := range r.servers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		answer, err := r.exchangeWith(ctx, msg, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if answer.Rcode == dns.RcodeServerFailure || answer.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("%s answered %s", server, dns.RcodeToString[answer.Rcode])
+			continue
+		}
+		return answer, nil
+	}
+	return nil, fmt.Errorf("failed to query dns: %s", lastErr)
+}
+
+// exchangeWith sends a query to a given resolver,
+// retrying over TCP if the UDP answer is truncated.
+//
+// Returns the answer.
+func (r *DnsResolver) exchangeWith(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, error) {
+	if !r.forceTCP {
+		answer, _, err := r.udp.ExchangeContext(ctx, msg, server)
+		if err != nil {
+			return nil, err
+		}
+		if !answer.Truncated {
+			return answer, nil
+		}
+	}
+	answer, _, err := r.tcp.ExchangeContext(ctx, msg, server)
+	return answer, err
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls sharing a key,
+// so that only one runs and all get its result, including errors.
+//
+// The zero value is ready to use,
+// and a nil *flightGroup runs every call.
+type flightGroup struct {
+	mu sync.Mutex
+	// In-flight calls, by key
+	calls map[string]*flightCall
+}
+
+// flightCall is a call in flight, or completed.
+type flightCall struct {
+	// Closed when the call is completed
+	done chan struct{}
+	// Result of the call
+	val interface{}
+	err error
+	// If f panicked, and with which value
+	panicked bool
+	panicVal interface{}
+}
+
+// errFlightAborted is the error of a call
+// whose function exited its goroutine without returning.
+var errFlightAborted = errors.New("call aborted")
+
+// do runs f, unless a call with the same key is in flight,
+// in which case it waits for the result of that call instead.
+//
+// A caller gives up waiting when its ctx is done.
+// As f usually runs with the context of the first caller,
+// waiting callers make their own call when the shared one
+// failed on a context error while their ctx is not done.
+func (g *flightGroup) do(ctx context.Context, key string, f func() (interface{}, error)) (interface{}, error) {
+	if g == nil {
+		return f()
+	}
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flightCall)
+		}
+		c, ok := g.calls[key]
+		if !ok {
+			c = &flightCall{done: make(chan struct{})}
+			g.calls[key] = c
+			g.mu.Unlock()
+			g.run(c, key, f)
+			return c.val, c.err
+		}
+		g.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if c.panicked {
+			panic(c.panicVal)
+		}
+		if (c.err == context.Canceled || c.err == context.DeadlineExceeded) && ctx.Err() == nil {
+			continue
+		}
+		return c.val, c.err
+	}
+}
+
+// run runs f as call c of a given key, then completes c.
+//
+// If f panics, c is completed all the same,
+// and the panic is passed on to the callers waiting for c.
+func (g *flightGroup) run(c *flightCall, key string, f func() (interface{}, error)) {
+	returned := false
+	defer func() {
+		if !returned {
+			if r := recover(); r != nil {
+				c.panicked, c.panicVal = true, r
+			} else {
+				c.err = errFlightAborted
+			}
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+		if c.panicked {
+			panic(c.panicVal)
+		}
+	}()
+	c.val, c.err = f()
+	returned = true
+}
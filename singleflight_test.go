@@ -0,0 +1,138 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleflightShared(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+	boom := errors.New("boom")
+	f := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "shared", boom
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := g.do(context.Background(), "key", f)
+			if val != "shared" || err != boom {
+				t.Errorf("unexpected result: %v %v", val, err)
+			}
+		}()
+	}
+	// Let callers join the flight before releasing it.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("unexpected number of calls: %d", n)
+	}
+	// Completed flights are not reused.
+	g.do(context.Background(), "key", f)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("unexpected number of calls: %d", n)
+	}
+}
+
+func TestSingleflightContext(t *testing.T) {
+	var g flightGroup
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go g.do(leaderCtx, "key", func() (interface{}, error) {
+		close(started)
+		<-leaderCtx.Done()
+		return nil, leaderCtx.Err()
+	})
+	<-started
+	// A waiting caller gives up when its own ctx is done.
+	ctx, stop := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer stop()
+	if _, err := g.do(ctx, "key", nil); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error of waiting caller: %v", err)
+	}
+	// A waiting caller makes its own call when the leader is canceled.
+	result := make(chan interface{})
+	go func() {
+		val, _ := g.do(context.Background(), "key", func() (interface{}, error) {
+			return "own", nil
+		})
+		result <- val
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if val := <-result; val != "own" {
+		t.Fatalf("unexpected result of waiting caller: %v", val)
+	}
+}
+
+func TestSingleflightPanic(t *testing.T) {
+	var g flightGroup
+	release := make(chan struct{})
+	f := func() (interface{}, error) {
+		<-release
+		panic("boom")
+	}
+	call := func() (recovered interface{}) {
+		defer func() {
+			recovered = recover()
+		}()
+		g.do(context.Background(), "key", f)
+		return nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r := call(); r != "boom" {
+				t.Errorf("unexpected panic: %v", r)
+			}
+		}()
+	}
+	// Let callers join the flight before releasing it.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	// Later calls of the key are not blocked
+	val, err := g.do(context.Background(), "key", func() (interface{}, error) {
+		return "after", nil
+	})
+	if val != "after" || err != nil {
+		t.Fatalf("unexpected result after panic: %v %v", val, err)
+	}
+}
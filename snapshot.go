@@ -0,0 +1,359 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cache snapshot format:
+//
+//	magic "GEOIPDBC", version (uvarint), number of entries (uvarint),
+//	then for each entry, from least to most recently used within a shard:
+//	  prefix: address length (byte), address, prefix length (byte)
+//	  expiry date (varint, Unix nanoseconds)
+//	  due date (varint, Unix nanoseconds)
+//	  insertion date (varint, Unix nanoseconds)
+//	  hits (uvarint)
+//	  flags (byte): snapshotNegative, snapshotOverriden
+//	  Asn, Descr, RawDescr, Source, Prefix, Country, Registry (strings)
+//	  IP addresses (uvarint count, then strings)
+//
+// Strings are written as their length (uvarint) followed by their bytes.
+const (
+	snapshotMagic   = "GEOIPDBC"
+	snapshotVersion = 1
+)
+
+// Entry flags of cache snapshots.
+const (
+	snapshotNegative = 1 << iota
+	snapshotOverriden
+)
+
+// Limits on decoded sizes, guarding against corrupted snapshots.
+const (
+	snapshotMaxString = 1 << 16
+	snapshotMaxIPs    = 1 << 20
+)
+
+// InvalidCacheSnapshotError is returned by CacheLoad
+// on malformed or truncated snapshots.
+var InvalidCacheSnapshotError = errors.New("invalid cache snapshot")
+
+// CacheSave writes a snapshot of the LookupAsn cache to w,
+// to be restored with CacheLoad.
+//
+// Returns CacheBackendUnsupportedError if the cache backend
+// has no Save method (as MemoryCache has).
+func (h Handler) CacheSave(w io.Writer) error {
+	s, ok := h.cache.backend.(cacheSnapshotter)
+	if !ok {
+		return CacheBackendUnsupportedError
+	}
+	return s.Save(w)
+}
+
+// CacheLoad adds the entries of a snapshot written by CacheSave
+// to the LookupAsn cache.
+// Entries already expired are dropped.
+//
+// Returns InvalidCacheSnapshotError if the snapshot is malformed,
+// in which case entries read before the error are kept,
+// or CacheBackendUnsupportedError if the cache backend
+// has no Load method (as MemoryCache has).
+func (h Handler) CacheLoad(r io.Reader) error {
+	s, ok := h.cache.backend.(cacheSnapshotter)
+	if !ok {
+		return CacheBackendUnsupportedError
+	}
+	return s.Load(r)
+}
+
+// saveSnapshot writes a snapshot of the cache to a given file,
+// replacing it atomically.
+func (c cache) saveSnapshot(path string) error {
+	s, ok := c.backend.(cacheSnapshotter)
+	if !ok {
+		return CacheBackendUnsupportedError
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := s.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(replacedFileMode(path)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadSnapshot adds the entries of a snapshot file to the cache.
+// A missing file is not an error.
+func (c cache) loadSnapshot(path string) error {
+	s, ok := c.backend.(cacheSnapshotter)
+	if !ok {
+		return CacheBackendUnsupportedError
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Load(f)
+}
+
+// Save writes a snapshot of the cache to w
+// (see Handler.CacheSave).
+func (m *MemoryCache) Save(w io.Writer) error {
+	// Copy entries, so as not to hold locks while writing.
+	entries := m.entries()
+	sw := snapshotWriter{w: bufio.NewWriter(w)}
+	sw.w.WriteString(snapshotMagic)
+	sw.uvarint(snapshotVersion)
+	sw.uvarint(uint64(len(entries)))
+	for i := range entries {
+		sw.entry(&entries[i])
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// Load adds the unexpired entries of a snapshot to the cache
+// (see Handler.CacheLoad).
+func (m *MemoryCache) Load(r io.Reader) error {
+	sr := snapshotReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(sr.r, magic); err != nil || string(magic) != snapshotMagic {
+		return InvalidCacheSnapshotError
+	}
+	version := sr.uvarint()
+	if sr.err == nil && version != snapshotVersion {
+		return fmt.Errorf("unsupported cache snapshot version %d", version)
+	}
+	n := sr.uvarint()
+	now := time.Now()
+	for i := uint64(0); i < n && sr.err == nil; i++ {
+		entry := sr.entry()
+		if sr.err != nil || !entry.Expires.After(now) {
+			continue
+		}
+		s := m.prefixShard(entry.Prefix)
+		s.mu.Lock()
+		if value, ok := s.prefixes.get(entry.Prefix); ok {
+			s.remove(value.(*memEntry))
+		}
+		s.add(entry)
+		s.mu.Unlock()
+	}
+	if sr.err != nil {
+		return InvalidCacheSnapshotError
+	}
+	return nil
+}
+
+// snapshotWriter encodes cache snapshots,
+// keeping the first write error.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+func (sw *snapshotWriter) uvarint(x uint64) {
+	sw.write(sw.buf[:binary.PutUvarint(sw.buf[:], x)])
+}
+
+func (sw *snapshotWriter) varint(x int64) {
+	sw.write(sw.buf[:binary.PutVarint(sw.buf[:], x)])
+}
+
+func (sw *snapshotWriter) string(s string) {
+	sw.uvarint(uint64(len(s)))
+	sw.write([]byte(s))
+}
+
+func (sw *snapshotWriter) entry(entry *CacheEntry) {
+	ip := entry.Prefix.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ones, _ := entry.Prefix.Mask.Size()
+	sw.write([]byte{byte(len(ip))})
+	sw.write(ip)
+	sw.write([]byte{byte(ones)})
+	sw.varint(entry.Expires.UnixNano())
+	sw.varint(entry.Due.UnixNano())
+	sw.varint(entry.Inserted.UnixNano())
+	sw.uvarint(entry.Hits)
+	var flags byte
+	if entry.Negative {
+		flags |= snapshotNegative
+	}
+	if entry.Info.Overriden {
+		flags |= snapshotOverriden
+	}
+	sw.write([]byte{flags})
+	info := entry.Info
+	for _, s := range []string{info.Asn, info.Descr, info.RawDescr, info.Source, info.Prefix, info.Country, info.Registry} {
+		sw.string(s)
+	}
+	sw.uvarint(uint64(len(entry.IPs)))
+	for _, ip := range entry.IPs {
+		sw.string(ip)
+	}
+}
+
+// snapshotReader decodes cache snapshots,
+// keeping the first read error.
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (sr *snapshotReader) fail(err error) {
+	if sr.err == nil {
+		sr.err = err
+	}
+}
+
+func (sr *snapshotReader) byte() byte {
+	if sr.err != nil {
+		return 0
+	}
+	b, err := sr.r.ReadByte()
+	sr.fail(err)
+	return b
+}
+
+func (sr *snapshotReader) uvarint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(sr.r)
+	sr.fail(err)
+	return x
+}
+
+func (sr *snapshotReader) varint() int64 {
+	if sr.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(sr.r)
+	sr.fail(err)
+	return x
+}
+
+func (sr *snapshotReader) bytes(n uint64) []byte {
+	if sr.err != nil {
+		return nil
+	}
+	if n > snapshotMaxString {
+		sr.fail(InvalidCacheSnapshotError)
+		return nil
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(sr.r, b)
+	sr.fail(err)
+	return b
+}
+
+func (sr *snapshotReader) string() string {
+	return string(sr.bytes(sr.uvarint()))
+}
+
+func (sr *snapshotReader) entry() *memEntry {
+	entry := &memEntry{ips: make(map[string]interface{})}
+	ip := net.IP(sr.bytes(uint64(sr.byte())))
+	ones := int(sr.byte())
+	if sr.err == nil && (len(ip) != net.IPv4len && len(ip) != net.IPv6len || ones > 8*len(ip)) {
+		sr.fail(InvalidCacheSnapshotError)
+	}
+	if ip4 := ip.To4(); sr.err == nil && len(ip) == net.IPv6len && ip4 != nil {
+		// IPv4-mapped prefix, kept in its IPv4 form like by the cache
+		const mappedBits = 8 * (net.IPv6len - net.IPv4len)
+		if ones < mappedBits {
+			sr.fail(InvalidCacheSnapshotError)
+		}
+		ip, ones = ip4, ones-mappedBits
+	}
+	if sr.err != nil {
+		return entry
+	}
+	entry.Prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 8*len(ip))}
+	entry.Expires = time.Unix(0, sr.varint())
+	entry.Due = time.Unix(0, sr.varint())
+	entry.Inserted = time.Unix(0, sr.varint())
+	entry.Hits = sr.uvarint()
+	flags := sr.byte()
+	info := &entry.Info
+	for _, s := range []*string{&info.Asn, &info.Descr, &info.RawDescr, &info.Source, &info.Prefix, &info.Country, &info.Registry} {
+		*s = sr.string()
+	}
+	info.Number = asnNumber(info.Asn)
+	info.Overriden = flags&snapshotOverriden != 0
+	info.Expires = entry.Expires
+	n := sr.uvarint()
+	if n > snapshotMaxIPs {
+		sr.fail(InvalidCacheSnapshotError)
+	}
+	for i := uint64(0); i < n && sr.err == nil; i++ {
+		entry.ips[sr.string()] = nil
+	}
+	if flags&snapshotNegative != 0 {
+		entry.Info = AsnInfo{}
+		entry.Negative = true
+	}
+	return entry
+}
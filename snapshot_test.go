@@ -0,0 +1,184 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	c := newCache(CacheConfig{NegativeTTL: time.Hour, SweepInterval: -1})
+	cloudflare := AsnInfo{Asn: "AS13335", Number: 13335, Descr: "Cloudflare", RawDescr: "CLOUDFLARENET",
+		Overriden: true, Source: "cymru-origin", Prefix: "1.0.0.0/24", Country: "AU", Registry: "apnic"}
+	c.store(netip.MustParseAddr("1.0.0.3"), cloudflare)
+	c.store(netip.MustParseAddr("1.0.0.4"), cloudflare)
+	c.store(netip.MustParseAddr("2001:4860::1"), AsnInfo{Asn: "AS15169", Number: 15169, Source: "mmdb", Prefix: "2001:4860::/32"})
+	c.store(netip.MustParseAddr("1.0.1.1"), AsnInfo{Asn: "AS1", Source: "libgeoip"})
+	c.store(netip.MustParseAddr("8.8.8.8"), AsnInfo{Asn: "AS15169", Source: "libgeoip"})
+	c.storeError(netip.MustParseAddr("45.45.45.45"), unknownAsnError("45.45.45.45"))
+	// Expire an entry, which is dropped on load.
+	m := memoryBackend(c)
+	s := memoryShard(c, "8.8.8.8")
+	s.mu.Lock()
+	value, _ := s.prefixes.match(netip.MustParseAddr("8.8.8.8"))
+	value.(*memEntry).Expires = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+	// Make 1.0.0.3 the most recently used entry.
+	c.lookupByIP(netip.MustParseAddr("1.0.0.3"))
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	loaded := newCache(CacheConfig{SweepInterval: -1})
+	if err := memoryBackend(loaded).Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	checkCacheIndexes(t, loaded)
+	// Recency order is kept within a shard.
+	if front := memoryShard(loaded, "1.0.0.3").lru.Front().Value.(*memEntry); front.Prefix.String() != "1.0.0.0/24" {
+		t.Fatalf("unexpected most recently used entry: %s", front.Prefix)
+	}
+	if n := memoryBackend(loaded).Len(); n != 4 {
+		t.Fatalf("unexpected number of loaded entries: %d", n)
+	}
+	for _, ip := range []string{"1.0.0.200", "2001:4860::2"} {
+		expected, _, _, _ := c.lookupByIP(netip.MustParseAddr(ip))
+		info, _, found, _ := loaded.lookupByIP(netip.MustParseAddr(ip))
+		if !info.Expires.Equal(expected.Expires) {
+			t.Fatalf("unexpected loaded expiry of %s: %s, expected %s", ip, info.Expires, expected.Expires)
+		}
+		expected.Expires = info.Expires
+		if !found || !reflect.DeepEqual(info, expected) {
+			t.Fatalf("unexpected loaded data of %s: %+v, expected %+v", ip, info, expected)
+		}
+	}
+	if _, _, found, _ := loaded.lookupByIP(netip.MustParseAddr("8.8.8.8")); found {
+		t.Fatalf("expired entry loaded")
+	}
+	if _, _, _, err := loaded.lookupByIP(netip.MustParseAddr("45.45.45.45")); err == nil || err.Error() != "unknown ASN for ip '45.45.45.45'" {
+		t.Fatalf("unexpected loaded negative entry: %v", err)
+	}
+	var ips []string
+	for ip := range loaded.lookupByASN("AS13335") {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	if !reflect.DeepEqual(ips, []string{"1.0.0.3", "1.0.0.4"}) {
+		t.Fatalf("unexpected loaded IPs of AS13335: %v", ips)
+	}
+}
+
+func TestCacheSnapshotInvalid(t *testing.T) {
+	m := NewMemoryCache(0, -1)
+	_, prefix, _ := net.ParseCIDR("1.0.0.0/24")
+	m.Store(netip.MustParseAddr("1.0.0.3"), CacheEntry{Prefix: prefix, Info: AsnInfo{Asn: "AS13335"}})
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	snapshot := buf.Bytes()
+	tests := map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("GEOIPDBX"), snapshot[len(snapshotMagic):]...),
+		"truncated": snapshot[:len(snapshot)-1],
+	}
+	for name, data := range tests {
+		if err := NewMemoryCache(0, -1).Load(bytes.NewReader(data)); err != InvalidCacheSnapshotError {
+			t.Fatalf("unexpected error loading %s snapshot: %v", name, err)
+		}
+	}
+	future := append([]byte(snapshotMagic), 99)
+	if err := NewMemoryCache(0, -1).Load(bytes.NewReader(future)); err == nil || err == InvalidCacheSnapshotError {
+		t.Fatalf("unexpected error loading snapshot of unknown version: %v", err)
+	}
+}
+
+func TestCacheSnapshotMapped(t *testing.T) {
+	m := NewMemoryCache(0, -1)
+	_, prefix, _ := net.ParseCIDR("1.0.0.0/24")
+	m.Store(netip.MustParseAddr("1.0.0.3"), CacheEntry{Prefix: prefix, Expires: time.Now().Add(time.Hour), Info: AsnInfo{Asn: "AS13335"}})
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+	// Prefixes written in IPv4-mapped form
+	ipv4 := []byte{net.IPv4len, 1, 0, 0, 0, 24}
+	mapped := append([]byte{net.IPv6len}, net.IPv4(1, 0, 0, 0)...)
+	snapshot := bytes.Replace(buf.Bytes(), ipv4, append(mapped, 120), 1)
+	loaded := NewMemoryCache(0, -1)
+	if err := loaded.Load(bytes.NewReader(snapshot)); err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	entry, ok, err := loaded.Lookup(netip.MustParseAddr("1.0.0.200"))
+	if err != nil || !ok || entry.Prefix.String() != "1.0.0.0/24" || entry.Info.Asn != "AS13335" {
+		t.Fatalf("unexpected loaded entry: %+v %v %v", entry, ok, err)
+	}
+	// Mapped prefixes are no wider than the IPv4 space
+	snapshot = bytes.Replace(buf.Bytes(), ipv4, append(mapped, 80), 1)
+	if err := NewMemoryCache(0, -1).Load(bytes.NewReader(snapshot)); err != InvalidCacheSnapshotError {
+		t.Fatalf("unexpected error loading wide mapped prefix: %v", err)
+	}
+}
+
+func TestCacheSnapshotPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoipdb")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snapshot")
+	config := CacheConfig{SnapshotPath: path}
+	h, err := NewHandler(nil, 0, WithCache(config), WithSources())
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	h.cache.store(netip.MustParseAddr("1.0.0.3"), AsnInfo{Asn: "AS13335", Prefix: "1.0.0.0/24"})
+	if err := h.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatalf("cannot stat snapshot: %s", err)
+	} else if info.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected snapshot file mode: %v", info.Mode())
+	}
+	h, err = NewHandler(nil, 0, WithCache(config), WithSources())
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	if asn, _, err := h.LookupAsn("1.0.0.9"); err != nil || asn != "AS13335" {
+		t.Fatalf("unexpected LookupAsn result after restart: %s %v", asn, err)
+	}
+}
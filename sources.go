@@ -0,0 +1,228 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/abh/geoip"
+	"github.com/turbobytes/geoipdb/iputils"
+	"github.com/turbobytes/geoipdb/mmdb"
+)
+
+// SourceNotApplicableError is returned by an AsnSource
+// that cannot be queried with the given parameters,
+// e.g. CymruDnsSource when no ASN is known yet.
+// LookupAsn silently skips such sources.
+var SourceNotApplicableError = errors.New("source not applicable")
+
+// SourceUnknownAsnError is returned by an AsnSource
+// that does not know the ASN of the given IP address.
+// LookupAsn caches such answers for CacheConfig.NegativeTTL,
+// unlike other source errors which are not cached.
+var SourceUnknownAsnError = errors.New("ASN unknown to source")
+
+// AsnSource is a provider of ASN data.
+//
+// LookupAsn queries its sources in order (see WithSources)
+// until one of them answers both an ASN and its description.
+type AsnSource interface {
+	// Name answers a short identification of the source.
+	Name() string
+	// LookupAsn searches for the ASN of a valid IP address.
+	//
+	// Parameter ctx bounds the time spent in the lookup.
+	//
+	// Parameter asn, if not empty,
+	// is an ASN already found for ip by a preceding source
+	// that could not describe it.
+	//
+	// Returns the ASN data of ip, or SourceUnknownAsnError.
+	// Field Asn must be set, Descr may be empty,
+	// and fields Prefix, Country and Registry are set if known.
+	// Other fields are set by the caller.
+	LookupAsn(ctx context.Context, ip string, asn string) (AsnInfo, error)
+}
+
+// AsnDescriber is an AsnSource which can only describe
+// an ASN already found by a preceding source, e.g. CymruDnsSource.
+//
+// LookupAsnBatch queries such sources once per distinct ASN.
+type AsnDescriber interface {
+	AsnSource
+	// DescribeAsn searches for the description of a given ASN.
+	DescribeAsn(ctx context.Context, asn string) (string, error)
+}
+
+// DefaultSources answers the sources queried by LookupAsn
+// when a Handler is created without WithSources:
+// libgeoip, ipinfo.io, Team Cymru's IP to ASN mapping
+// and Team Cymru's ASN descriptions, in this order.
+//
+// Parameter timeout is honored by sources that access external services.
+// Pass zero to disable timeout.
+func DefaultSources(timeout time.Duration) ([]AsnSource, error) {
+	gi, err := NewLibGeoipSource()
+	if err != nil {
+		return nil, err
+	}
+	return []AsnSource{
+		gi,
+		NewIpInfoSource(timeout),
+		NewCymruOriginSource(timeout),
+		NewCymruDnsSource(timeout),
+	}, nil
+}
+
+// LibGeoipSource is an AsnSource backed by the libgeoip ASN databases.
+type LibGeoipSource struct {
+	geoip4 *geoip.GeoIP
+	geoip6 *geoip.GeoIP
+}
+
+// NewLibGeoipSource opens the libgeoip ASN databases
+// for both IPv4 and IPv6.
+func NewLibGeoipSource() (*LibGeoipSource, error) {
+	ge4, err := geoip.OpenType(geoip.GEOIP_ASNUM_EDITION)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open GeoIP database: %s", err)
+	}
+	ge6, err := geoip.OpenType(geoip.GEOIP_ASNUM_EDITION_V6)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open GeoIP database: %s", err)
+	}
+	return &LibGeoipSource{
+		geoip4: ge4,
+		geoip6: ge6,
+	}, nil
+}
+
+// Name implements AsnSource.
+func (s *LibGeoipSource) Name() string {
+	return "libgeoip"
+}
+
+// LookupAsn implements AsnSource.
+func (s *LibGeoipSource) LookupAsn(_ context.Context, ip string, _ string) (AsnInfo, error) {
+	info := s.lookup(ip)
+	if info.Asn == "" {
+		return AsnInfo{}, SourceUnknownAsnError
+	}
+	return info, nil
+}
+
+// lookup queries the libgeoip database for the ASN of a given ip address.
+//
+// Returns the ASN data of ip, with an empty Asn if not found.
+func (s *LibGeoipSource) lookup(ip string) AsnInfo {
+	var name string
+	var netmask int
+	ipAddr, isIPv4 := iputils.ParseIP(ip)
+	if ipAddr == nil {
+		return AsnInfo{}
+	}
+	if isIPv4 {
+		ipAddr = ipAddr.To4()
+		name, netmask = s.geoip4.GetName(ip)
+	} else {
+		name, netmask = s.geoip6.GetNameV6(ip)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return AsnInfo{}
+	}
+	var info AsnInfo
+	answer := strings.SplitN(name, " ", 2)
+	info.Asn = answer[0]
+	if len(answer) > 1 {
+		info.Descr = answer[1]
+	}
+	if netmask > 0 {
+		mask := net.CIDRMask(netmask, len(ipAddr)*8)
+		if mask != nil {
+			info.Prefix = (&net.IPNet{IP: ipAddr.Mask(mask), Mask: mask}).String()
+		}
+	}
+	return info
+}
+
+// MmdbSource is an AsnSource backed by a MaxMind DB file
+// in GeoLite2-ASN format,
+// such as GeoLite2-ASN.mmdb or DB-IP ASN Lite databases.
+type MmdbSource struct {
+	db *mmdb.Reader
+}
+
+// NewMmdbSource opens a MaxMind DB file.
+func NewMmdbSource(path string) (*MmdbSource, error) {
+	db, err := mmdb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open MaxMind DB: %s", err)
+	}
+	return &MmdbSource{
+		db: db,
+	}, nil
+}
+
+// Name implements AsnSource.
+func (s *MmdbSource) Name() string {
+	return "mmdb"
+}
+
+// LookupAsn implements AsnSource.
+func (s *MmdbSource) LookupAsn(_ context.Context, ip string, _ string) (AsnInfo, error) {
+	info := s.lookup(ip)
+	if info.Asn == "" {
+		return AsnInfo{}, SourceUnknownAsnError
+	}
+	return info, nil
+}
+
+// lookup queries the MaxMind DB for the ASN of a given ip address.
+//
+// Returns the ASN data of ip, with an empty Asn if not found.
+func (s *MmdbSource) lookup(ip string) AsnInfo {
+	record, network, err := s.db.Lookup(net.ParseIP(ip))
+	if err != nil {
+		return AsnInfo{}
+	}
+	fields, _ := record.(map[string]interface{})
+	number, ok := fields["autonomous_system_number"].(uint64)
+	if !ok {
+		return AsnInfo{}
+	}
+	org, _ := fields["autonomous_system_organization"].(string)
+	return AsnInfo{
+		Asn:    fmt.Sprintf("AS%d", number),
+		Descr:  strings.TrimSpace(org),
+		Prefix: network.String(),
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/geoipdb"
+)
+
+// fakeSource is an AsnSource answering canned data.
+type fakeSource struct {
+	name   string
+	asn    string
+	descr  string
+	prefix string
+	err    error
+	// Wait for ctx to be done before answering
+	block bool
+	// ASN hints received by LookupAsn, one per call.
+	hints []string
+	// IP addresses received by LookupAsn, one per call.
+	ips []string
+}
+
+func (s *fakeSource) Name() string {
+	return s.name
+}
+
+func (s *fakeSource) LookupAsn(ctx context.Context, ip string, asn string) (geoipdb.AsnInfo, error) {
+	s.hints = append(s.hints, asn)
+	s.ips = append(s.ips, ip)
+	if s.block {
+		<-ctx.Done()
+		return geoipdb.AsnInfo{}, ctx.Err()
+	}
+	if s.err != nil {
+		return geoipdb.AsnInfo{}, s.err
+	}
+	return geoipdb.AsnInfo{Asn: s.asn, Descr: s.descr, Prefix: s.prefix}, nil
+}
+
+func newSourcesHandler(t *testing.T, sources ...geoipdb.AsnSource) geoipdb.Handler {
+	h, err := geoipdb.NewHandler(nil, 0, geoipdb.WithSources(sources...))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	return h
+}
+
+func TestSourcesFirstAnswerWins(t *testing.T) {
+	first := &fakeSource{name: "first", asn: "AS1", descr: "First"}
+	second := &fakeSource{name: "second", asn: "AS2", descr: "Second"}
+	h := newSourcesHandler(t, first, second)
+	asn, descr, err := h.LookupAsn("8.8.8.8")
+	if err != nil {
+		t.Fatalf("LookupAsn failed: %s", err)
+	}
+	if asn != "AS1" || descr != "First" {
+		t.Fatalf("unexpected LookupAsn result: %s %s", asn, descr)
+	}
+	if len(second.hints) != 0 {
+		t.Fatalf("second source was queried")
+	}
+}
+
+func TestSourcesFallback(t *testing.T) {
+	failing := &fakeSource{name: "failing", err: errors.New("boom")}
+	undescribed := &fakeSource{name: "undescribed", asn: "AS1"}
+	describer := &fakeSource{name: "describer", asn: "AS1", descr: "Described"}
+	h := newSourcesHandler(t, failing, undescribed, describer)
+	asn, descr, err := h.LookupAsn("8.8.4.4")
+	if err != nil {
+		t.Fatalf("LookupAsn failed: %s", err)
+	}
+	if asn != "AS1" || descr != "Described" {
+		t.Fatalf("unexpected LookupAsn result: %s %s", asn, descr)
+	}
+	if len(describer.hints) != 1 || describer.hints[0] != "AS1" {
+		t.Fatalf("unexpected ASN hints received by describer: %v", describer.hints)
+	}
+}
+
+func TestSourcesUndescribedAsn(t *testing.T) {
+	undescribed := &fakeSource{name: "undescribed", asn: "AS1"}
+	skipped := &fakeSource{name: "skipped", err: geoipdb.SourceNotApplicableError}
+	h := newSourcesHandler(t, undescribed, skipped)
+	asn, descr, err := h.LookupAsn("1.0.0.1")
+	if err != nil {
+		t.Fatalf("LookupAsn failed: %s", err)
+	}
+	if asn != "AS1" || descr != "" {
+		t.Fatalf("unexpected LookupAsn result: %s %s", asn, descr)
+	}
+}
+
+func TestSourcesUnknownAsn(t *testing.T) {
+	h := newSourcesHandler(t,
+		&fakeSource{name: "failing", err: errors.New("boom")},
+		&fakeSource{name: "unknowing", err: geoipdb.SourceUnknownAsnError})
+	_, _, err := h.LookupAsn("1.0.0.2")
+	if err == nil || err.Error() != "unknown ASN for ip '1.0.0.2'" {
+		t.Fatalf("unexpected LookupAsn error: %v", err)
+	}
+}
+
+func TestLookupAsnInfo(t *testing.T) {
+	undescribed := &fakeSource{name: "undescribed", asn: "AS13335", prefix: "1.0.0.0/24"}
+	describer := &fakeSource{name: "describer", asn: "AS13335", descr: "CLOUDFLARENET"}
+	h := newSourcesHandler(t, undescribed, describer)
+	info, err := h.LookupAsnInfo("1.0.0.3")
+	if err != nil {
+		t.Fatalf("LookupAsnInfo failed: %s", err)
+	}
+	if info.Asn != "AS13335" || info.Number != 13335 || info.Descr != "CLOUDFLARENET" || info.RawDescr != "CLOUDFLARENET" {
+		t.Fatalf("unexpected LookupAsnInfo ASN data: %+v", info)
+	}
+	if info.Source != "undescribed" || info.Prefix != "1.0.0.0/24" || info.Overriden {
+		t.Fatalf("unexpected LookupAsnInfo source data: %+v", info)
+	}
+	if info.Cache != geoipdb.CacheMiss || info.Expires.Before(time.Now()) {
+		t.Fatalf("unexpected LookupAsnInfo cache data: %+v", info)
+	}
+	cached, err := h.LookupAsnInfo("1.0.0.3")
+	if err != nil {
+		t.Fatalf("LookupAsnInfo failed: %s", err)
+	}
+	if cached.Cache != geoipdb.CacheHit || cached.Asn != info.Asn || !cached.Expires.Equal(info.Expires) {
+		t.Fatalf("unexpected cached LookupAsnInfo result: %+v", cached)
+	}
+	if len(undescribed.hints) != 1 {
+		t.Fatalf("LookupAsnInfo missed the cache")
+	}
+}
+
+func TestLookupAsnNegativeCache(t *testing.T) {
+	unknowing := &fakeSource{name: "unknowing", err: geoipdb.SourceUnknownAsnError}
+	h, err := geoipdb.NewHandler(nil, 0,
+		geoipdb.WithSources(unknowing),
+		geoipdb.WithCache(geoipdb.CacheConfig{NegativeTTL: time.Hour}))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	for i := 0; i < 2; i++ {
+		_, _, err := h.LookupAsn("1.0.0.9")
+		if err == nil || err.Error() != "unknown ASN for ip '1.0.0.9'" {
+			t.Fatalf("unexpected LookupAsn error: %v", err)
+		}
+	}
+	if len(unknowing.hints) != 1 {
+		t.Fatalf("unknown ASN not cached: %d source queries", len(unknowing.hints))
+	}
+}
+
+func TestLookupAsnSourcesFailed(t *testing.T) {
+	failing := &fakeSource{name: "failing", err: errors.New("boom")}
+	h, err := geoipdb.NewHandler(nil, 0,
+		geoipdb.WithSources(failing),
+		geoipdb.WithCache(geoipdb.CacheConfig{NegativeTTL: time.Hour}))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	for i := 0; i < 2; i++ {
+		_, _, err := h.LookupAsn("1.0.0.10")
+		if err == nil || err.Error() != "cannot lookup ASN for ip '1.0.0.10': boom" {
+			t.Fatalf("unexpected LookupAsn error: %v", err)
+		}
+	}
+	if len(failing.hints) != 2 {
+		t.Fatalf("source failure cached: %d source queries", len(failing.hints))
+	}
+}
+
+// staleSource is a concurrency safe AsnSource
+// answering a new ASN on every call, or failing if told so.
+type staleSource struct {
+	mu    sync.Mutex
+	calls int
+	fail  bool
+	// Receives a value after each call
+	done chan struct{}
+}
+
+func (s *staleSource) Name() string {
+	return "stale"
+}
+
+func (s *staleSource) LookupAsn(ctx context.Context, ip string, _ string) (geoipdb.AsnInfo, error) {
+	defer func() { s.done <- struct{}{} }()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.fail {
+		return geoipdb.AsnInfo{}, errors.New("boom")
+	}
+	return geoipdb.AsnInfo{Asn: fmt.Sprintf("AS%d", s.calls), Descr: "Stale"}, nil
+}
+
+func (s *staleSource) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func TestLookupAsnStaleWhileRevalidate(t *testing.T) {
+	src := &staleSource{done: make(chan struct{}, 10)}
+	ttl := 20 * time.Millisecond
+	h, err := geoipdb.NewHandler(nil, 0,
+		geoipdb.WithSources(src),
+		geoipdb.WithCache(geoipdb.CacheConfig{TTL: ttl, MaxStale: time.Hour}))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	lookup := func() geoipdb.AsnInfo {
+		info, err := h.LookupAsnInfo("1.0.0.1")
+		if err != nil {
+			t.Fatalf("LookupAsnInfo failed: %s", err)
+		}
+		return info
+	}
+	if info := lookup(); info.Asn != "AS1" || info.Cache != geoipdb.CacheMiss {
+		t.Fatalf("unexpected first answer: %+v", info)
+	}
+	<-src.done
+	time.Sleep(2 * ttl)
+	// Expired data is answered, and refreshed in the background.
+	if info := lookup(); info.Asn != "AS1" || info.Cache != geoipdb.CacheStale {
+		t.Fatalf("unexpected stale answer: %+v", info)
+	}
+	<-src.done
+	deadline := time.Now().Add(time.Second)
+	for info := lookup(); info.Asn != "AS2"; info = lookup() {
+		if time.Now().After(deadline) {
+			t.Fatalf("stale data not refreshed: %+v", info)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Stale data is kept on refresh failure.
+	src.setFail(true)
+	time.Sleep(2 * ttl)
+	if info := lookup(); info.Asn != "AS2" || info.Cache != geoipdb.CacheStale {
+		t.Fatalf("unexpected stale answer: %+v", info)
+	}
+	<-src.done
+	time.Sleep(10 * time.Millisecond)
+	if info := lookup(); info.Asn != "AS2" || info.Cache != geoipdb.CacheStale {
+		t.Fatalf("stale data lost on refresh failure: %+v", info)
+	}
+}
+
+// slowSource is a concurrency safe AsnSource
+// answering after a delay, and counting calls.
+type slowSource struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *slowSource) Name() string {
+	return "slow"
+}
+
+func (s *slowSource) LookupAsn(ctx context.Context, ip string, _ string) (geoipdb.AsnInfo, error) {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	return geoipdb.AsnInfo{Asn: "AS13335", Descr: "CLOUDFLARENET"}, nil
+}
+
+func TestLookupAsnSingleflight(t *testing.T) {
+	src := &slowSource{}
+	h := newSourcesHandler(t, src)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			asn, _, err := h.LookupAsn("1.0.0.1")
+			if err != nil || asn != "AS13335" {
+				t.Errorf("unexpected LookupAsn result: %s %v", asn, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if src.calls != 1 {
+		t.Fatalf("concurrent misses not coalesced: %d source queries", src.calls)
+	}
+}
+
+func TestLookupAsnCanonicalIP(t *testing.T) {
+	src := &fakeSource{name: "fake", asn: "AS15169", descr: "GOOGLE"}
+	h := newSourcesHandler(t, src)
+	for _, ip := range []string{"::ffff:8.8.8.8", "8.8.8.8", "::FFFF:808:808", "2001:4860:0:0::1", "2001:4860::1"} {
+		if asn, _, err := h.LookupAsn(ip); err != nil || asn != "AS15169" {
+			t.Fatalf("unexpected LookupAsn(%s) result: %s %v", ip, asn, err)
+		}
+	}
+	if fmt.Sprint(src.ips) != "[8.8.8.8 2001:4860::1]" {
+		t.Fatalf("unexpected source queries: %v", src.ips)
+	}
+	ips := h.LookupIp("AS15169")
+	sort.Strings(ips)
+	if fmt.Sprint(ips) != "[2001:4860::1 8.8.8.8]" {
+		t.Fatalf("unexpected cached IPs: %v", ips)
+	}
+	if _, _, err := h.LookupAsn("::ffff:10.0.0.1"); err != geoipdb.PrivateIPError {
+		t.Fatalf("unexpected error for IPv4-mapped private address: %v", err)
+	}
+	if _, _, err := h.LookupAsn("fe80::1%eth0"); err != geoipdb.MalformedIPError {
+		t.Fatalf("unexpected error for zoned address: %v", err)
+	}
+}
+
+func TestLookupAsnContextDeadline(t *testing.T) {
+	first := &fakeSource{name: "first", block: true}
+	second := &fakeSource{name: "second", block: true}
+	h := newSourcesHandler(t, first, second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := h.LookupAsnContext(ctx, "1.0.0.3")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected LookupAsnContext error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("LookupAsnContext took too long: %s", elapsed)
+	}
+	if len(second.hints) != 0 {
+		t.Fatalf("second source was queried after deadline")
+	}
+}
+
+func TestLookupAsnContextCanceled(t *testing.T) {
+	src := &fakeSource{name: "src", asn: "AS1", descr: "One"}
+	h := newSourcesHandler(t, src)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := h.LookupAsnContext(ctx, "1.0.0.4")
+	if err != context.Canceled {
+		t.Fatalf("unexpected LookupAsnContext error: %v", err)
+	}
+	if len(src.hints) != 0 {
+		t.Fatalf("source was queried with a canceled context")
+	}
+}
+
+// mmdbFixture is a small GeoLite2-ASN like database.
+const mmdbFixture = "mmdb/testdata/GeoLite2-ASN-Test.mmdb"
+
+func TestMmdbSource(t *testing.T) {
+	db, err := geoipdb.NewMmdbSource(mmdbFixture)
+	if err != nil {
+		t.Fatalf("NewMmdbSource failed: %s", err)
+	}
+	h := newSourcesHandler(t, db)
+	tests := []struct {
+		ip    string
+		asn   string
+		descr string
+	}{
+		{"8.8.8.8", "AS15169", "GOOGLE"},
+		{"1.0.0.1", "AS13335", "CLOUDFLARENET"},
+		{"2001:4860:1004::876:102", "AS15169", "GOOGLE"},
+		{"9.9.9.9", "", ""},
+	}
+	for _, test := range tests {
+		asn, descr := h.MmdbLookup(test.ip)
+		if asn != test.asn || descr != test.descr {
+			t.Fatalf("unexpected MmdbLookup(\"%s\") result: %s %s", test.ip, asn, descr)
+		}
+	}
+	asn, descr, err := h.LookupAsn("2606:4700:4700::1111")
+	if err != nil || asn != "AS13335" || descr != "CLOUDFLARENET" {
+		t.Fatalf("unexpected LookupAsn result: %s %s %v", asn, descr, err)
+	}
+}
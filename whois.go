@@ -0,0 +1,181 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/turbobytes/geoipdb/iputils"
+)
+
+// DefaultCymruWhoisServer is the address of Team Cymru's whois service.
+const DefaultCymruWhoisServer = "whois.cymru.com:43"
+
+// CymruWhoisClient is a client of Team Cymru's bulk whois service,
+// meant for mapping many IP addresses to ASNs at once.
+//
+// See https://www.team-cymru.com/ip-asn-mapping
+type CymruWhoisClient struct {
+	// Server is the address of the whois service.
+	// Empty means DefaultCymruWhoisServer.
+	Server string
+	// Timeout limits the duration of a bulk query.
+	// Zero disables timeout.
+	Timeout time.Duration
+}
+
+// Lookup maps a list of IP addresses to ASNs
+// in a single bulk query.
+// The query is abandoned when ctx is done.
+//
+// Returns
+// a result per IP address, in the same order as ips,
+// or an error if the bulk query failed as a whole.
+func (c *CymruWhoisClient) Lookup(ctx context.Context, ips []string) ([]BatchResult, error) {
+	results := make([]BatchResult, len(ips))
+	// Indexes of results, by canonical IP address
+	pending := make(map[string][]int)
+	var query bytes.Buffer
+	query.WriteString("begin\nverbose\n")
+	for i, ip := range ips {
+		results[i].IP = ip
+		addr, ok := iputils.ParseAddr(ip)
+		if !ok {
+			results[i].Err = MalformedIPError
+			continue
+		}
+		if iputils.IsLocalAddr(addr) {
+			results[i].Err = PrivateIPError
+			continue
+		}
+		key := addr.String()
+		if _, ok := pending[key]; !ok {
+			query.WriteString(key + "\n")
+		}
+		pending[key] = append(pending[key], i)
+	}
+	query.WriteString("end\n")
+	if len(pending) == 0 {
+		return results, nil
+	}
+	server := c.Server
+	if server == "" {
+		server = DefaultCymruWhoisServer
+	}
+	dialer := net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to '%s': %s", server, err)
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	// Interrupt pending I/O when ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	if _, err := conn.Write(query.Bytes()); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("cannot send whois query: %s", err)
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() && len(pending) > 0 {
+		ip, info, ok := parseCymruWhoisLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		for _, i := range pending[ip] {
+			if info.Asn == "" {
+				results[i].Err = unknownAsnError(results[i].IP)
+			} else {
+				results[i].AsnInfo = info
+			}
+		}
+		delete(pending, ip)
+	}
+	if err := scanner.Err(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("cannot read whois answer: %s", err)
+	}
+	for _, indexes := range pending {
+		for _, i := range indexes {
+			results[i].Err = unknownAsnError(results[i].IP)
+		}
+	}
+	return results, nil
+}
+
+// parseCymruWhoisLine parses a line of a verbose bulk whois answer, such as:
+//
+//	15169   | 8.8.8.8          | 8.8.8.0/24          | US | arin     | 1992-12-01 | GOOGLE - Google LLC, US
+//
+// Returns
+// the canonical IP address,
+// the ASN data (with an empty Asn if unknown),
+// and if line is a valid answer.
+func parseCymruWhoisLine(line string) (string, AsnInfo, bool) {
+	fields := strings.Split(line, "|")
+	if len(fields) < 3 {
+		return "", AsnInfo{}, false
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+		if fields[i] == "NA" {
+			fields[i] = ""
+		}
+	}
+	addr, ok := iputils.ParseAddr(fields[1])
+	if !ok {
+		return "", AsnInfo{}, false
+	}
+	info := AsnInfo{Asn: "AS" + fields[0], Source: "cymru-whois"}
+	if !reASN.MatchString(info.Asn) {
+		return addr.String(), AsnInfo{}, true
+	}
+	info.Descr = fields[len(fields)-1]
+	if len(fields) >= 7 {
+		info.Prefix, info.Country = fields[2], fields[3]
+		info.Registry = strings.ToLower(fields[4])
+	}
+	return addr.String(), info.normalized(), true
+}
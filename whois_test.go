@@ -0,0 +1,180 @@
+// Copyright (c) 2016 turbobytes
+//
+// This file is part of geoipdb, a library of GeoIP related helper functions
+// for TurboBytes stack.
+//
+// MIT License
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package geoipdb_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/geoipdb"
+)
+
+// whoisAnswers is a sample of Team Cymru's whois database.
+var whoisAnswers = map[string]string{
+	"8.8.8.8":                 "15169   | 8.8.8.8          | 8.8.8.0/24          | US | arin     | 1992-12-01 | GOOGLE - Google LLC, US",
+	"1.0.0.1":                 "13335   | 1.0.0.1          | 1.0.0.0/24          | AU | apnic    | 2011-08-11 | CLOUDFLARENET - Cloudflare, Inc., US",
+	"2001:4860:1004::876:102": "15169   | 2001:4860:1004::876:102 | 2001:4860::/32 | US | arin | 2005-03-14 | GOOGLE - Google LLC, US",
+	"45.45.45.45":             "NA      | 45.45.45.45      | NA                  | US | arin     | 2015-03-17 | NA",
+}
+
+// startWhoisServer runs a local bulk whois server until the test ends.
+//
+// Returns the server address and a channel receiving the queried IPs.
+func startWhoisServer(t *testing.T) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	queries := make(chan []string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			var lines, ips []string
+			for scanner.Scan() && scanner.Text() != "end" {
+				lines = append(lines, scanner.Text())
+			}
+			if len(lines) < 2 || lines[0] != "begin" || lines[1] != "verbose" {
+				fmt.Fprintf(conn, "Error: unexpected query %v\n", lines)
+				conn.Close()
+				continue
+			}
+			fmt.Fprintf(conn, "Bulk mode; whois.cymru.com [2016-10-16 10:00:00 +0000]\n")
+			for _, ip := range lines[2:] {
+				ips = append(ips, ip)
+				if answer, ok := whoisAnswers[ip]; ok {
+					fmt.Fprintln(conn, answer)
+				}
+			}
+			conn.Close()
+			queries <- ips
+		}
+	}()
+	return l.Addr().String(), queries
+}
+
+func TestCymruWhoisLookup(t *testing.T) {
+	addr, queries := startWhoisServer(t)
+	unused := &fakeSource{name: "unused", err: errors.New("not cached")}
+	h, err := geoipdb.NewHandler(nil, time.Second,
+		geoipdb.WithSources(unused),
+		geoipdb.WithCymruWhois(&geoipdb.CymruWhoisClient{Server: addr, Timeout: time.Second}))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	ips := []string{"8.8.8.8", "1.0.0.1", "2001:4860:1004:0::876:102", "45.45.45.45", "9.9.9.9", "10.0.0.1", "bogus", "8.8.8.8"}
+	results, err := h.CymruWhoisLookup(ips)
+	if err != nil {
+		t.Fatalf("CymruWhoisLookup failed: %s", err)
+	}
+	queried := <-queries
+	if strings.Join(queried, ",") != "8.8.8.8,1.0.0.1,2001:4860:1004::876:102,45.45.45.45,9.9.9.9" {
+		t.Fatalf("unexpected queried ips: %v", queried)
+	}
+	expected := []geoipdb.BatchResult{
+		{IP: "8.8.8.8", AsnInfo: geoipdb.AsnInfo{Asn: "AS15169", Descr: "GOOGLE - Google LLC, US"}},
+		{IP: "1.0.0.1", AsnInfo: geoipdb.AsnInfo{Asn: "AS13335", Descr: "CLOUDFLARENET - Cloudflare, Inc., US"}},
+		{IP: "2001:4860:1004:0::876:102", AsnInfo: geoipdb.AsnInfo{Asn: "AS15169", Descr: "GOOGLE - Google LLC, US"}},
+		{IP: "45.45.45.45", Err: errors.New("unknown ASN for ip '45.45.45.45'")},
+		{IP: "9.9.9.9", Err: errors.New("unknown ASN for ip '9.9.9.9'")},
+		{IP: "10.0.0.1", Err: geoipdb.PrivateIPError},
+		{IP: "bogus", Err: geoipdb.MalformedIPError},
+		{IP: "8.8.8.8", AsnInfo: geoipdb.AsnInfo{Asn: "AS15169", Descr: "GOOGLE - Google LLC, US"}},
+	}
+	for i, r := range results {
+		e := expected[i]
+		if r.IP != e.IP || r.Asn != e.Asn || r.Descr != e.Descr || fmt.Sprint(r.Err) != fmt.Sprint(e.Err) {
+			t.Fatalf("unexpected result %d: %+v, expected %+v", i, r, e)
+		}
+	}
+	// Successful results are cached.
+	asn, descr, err := h.LookupAsn("1.0.0.1")
+	if err != nil || asn != "AS13335" || descr != "CLOUDFLARENET - Cloudflare, Inc., US" {
+		t.Fatalf("unexpected LookupAsn result: %s %s %v", asn, descr, err)
+	}
+	if len(unused.hints) != 0 {
+		t.Fatalf("LookupAsn missed the cache")
+	}
+}
+
+func TestCymruWhoisLookupPrefixOverride(t *testing.T) {
+	addr, _ := startWhoisServer(t)
+	store := geoipdb.NewMemoryPrefixOverrides(
+		geoipdb.PrefixOverride{Prefix: "8.8.8.0/25", Asn: "AS64500", Name: "Customer"},
+		geoipdb.PrefixOverride{Prefix: "9.9.9.0/24", Asn: "AS19281", Name: "Quad9"},
+		geoipdb.PrefixOverride{Prefix: "10.0.0.0/8", Asn: "AS64501", Name: "Private"},
+	)
+	h, err := geoipdb.NewHandler(nil, time.Second,
+		geoipdb.WithSources(),
+		geoipdb.WithPrefixOverrides(store),
+		geoipdb.WithCymruWhois(&geoipdb.CymruWhoisClient{Server: addr, Timeout: time.Second}))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %s", err)
+	}
+	defer h.Close()
+	results, err := h.CymruWhoisLookup([]string{"8.8.8.8", "9.9.9.9", "1.0.0.1", "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("CymruWhoisLookup failed: %s", err)
+	}
+	expected := []geoipdb.BatchResult{
+		{IP: "8.8.8.8", AsnInfo: geoipdb.AsnInfo{Asn: "AS64500", Descr: "Customer"}},
+		{IP: "9.9.9.9", AsnInfo: geoipdb.AsnInfo{Asn: "AS19281", Descr: "Quad9"}},
+		{IP: "1.0.0.1", AsnInfo: geoipdb.AsnInfo{Asn: "AS13335", Descr: "CLOUDFLARENET - Cloudflare, Inc., US"}},
+		{IP: "10.0.0.1", Err: geoipdb.PrivateIPError},
+	}
+	for i, r := range results {
+		e := expected[i]
+		if r.IP != e.IP || r.Asn != e.Asn || r.Descr != e.Descr || fmt.Sprint(r.Err) != fmt.Sprint(e.Err) {
+			t.Fatalf("unexpected result %d: %+v, expected %+v", i, r, e)
+		}
+	}
+	if results[0].Source != geoipdb.PrefixOverrideSource {
+		t.Fatalf("unexpected source: %s", results[0].Source)
+	}
+}
+
+func TestCymruWhoisLookupUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	c := &geoipdb.CymruWhoisClient{Server: addr, Timeout: time.Second}
+	if _, err := c.Lookup(context.Background(), []string{"8.8.8.8"}); err == nil {
+		t.Fatalf("Lookup did not fail")
+	}
+}